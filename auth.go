@@ -0,0 +1,58 @@
+package sessions
+
+import (
+	"net/http"
+)
+
+// userIDKey is the key that the ID of the logged in user is stored under.
+const userIDKey = reservedPrefix + "user_id"
+
+// Login logs in the user with the given ID, replacing the session with a new
+// session that only holds the user's ID, with a single cookie write.
+//
+// Starting a new session on login ensures that any data set in the session
+// before the user logged in, for example, by an attacker who planted the
+// session cookie, doesn't carry over into the user's session.
+func (s *Session) Login(w http.ResponseWriter, r *http.Request, userID string) {
+	s.saveCtx(w, r, s.replace(r, &session{
+		Data:    map[string]interface{}{s.dataKey(userIDKey): userID},
+		Flashes: make(map[string]interface{}),
+	}))
+}
+
+// Logout logs out the user by resetting the session, and deletes any of the
+// session's other cookies from the request, such as those with one of the
+// FallbackNames or the flash cookie.
+func (s *Session) Logout(w http.ResponseWriter, r *http.Request) {
+	ss := s.fromReq(r)
+	s.Reset(w, r)
+
+	// Reset leaves a frozen or committed session as is, and logs why, so its
+	// other cookies are left as is too.
+	if ss.frozen || ss.committed {
+		return
+	}
+
+	// Saving the reset session already deletes the fallback cookie the
+	// session was read from and the flash cookie, so only the others are
+	// deleted here.
+	for _, name := range s.ManagedCookieNames(r) {
+		if name == s.name || name == ss.from || name == s.flashName && ss.flashCookie {
+			continue
+		}
+		s.deleteCookie(w, name)
+	}
+}
+
+// IsAuthenticated reports whether a user has logged in with the session from
+// the given request.
+func (s *Session) IsAuthenticated(r *http.Request) bool {
+	return s.UserID(r) != ""
+}
+
+// UserID returns the ID of the user that logged in with the session from the
+// given request, or an empty string if no user has logged in.
+func (s *Session) UserID(r *http.Request) string {
+	userID, _ := s.fromReq(r).Data[s.dataKey(userIDKey)].(string)
+	return userID
+}
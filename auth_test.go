@@ -0,0 +1,163 @@
+package sessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSessionLogin(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if s.IsAuthenticated(req) {
+		t.Fatal("expected new session not to be authenticated")
+	}
+
+	s.Set(rr, req, "planted", "value")
+
+	rr = httptest.NewRecorder()
+	s.Login(rr, req, "42")
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie but got %d", len(cookies))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[0])
+	if !s.IsAuthenticated(req) {
+		t.Fatal("expected session to be authenticated after login")
+	}
+	if id := s.UserID(req); id != "42" {
+		t.Fatalf("expected user ID 42 but got %q", id)
+	}
+	if s.Has(req, "planted") {
+		t.Fatal("expected data set before login to be discarded")
+	}
+
+	rr = httptest.NewRecorder()
+	s.Logout(rr, req)
+
+	cookies = rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+	if s.IsAuthenticated(req) {
+		t.Fatal("expected session not to be authenticated after logout")
+	}
+	if id := s.UserID(req); id != "" {
+		t.Fatalf("expected no user ID after logout but got %q", id)
+	}
+}
+
+func TestSessionLogoutTemplMiddleware(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+
+	rr := httptest.NewRecorder()
+	s.Login(rr, httptest.NewRequest(http.MethodGet, "/", nil), "42")
+
+	// Change the session before logging out, so that the session the
+	// middleware started with is changed as well.
+	h := s.TemplMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Set(w, r, "key", "value")
+		s.Logout(w, r)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(rr.Result().Cookies()[0])
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	cookies := rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+	if s.IsAuthenticated(req) {
+		t.Fatalf("expected the user to be logged out but got user %s", s.UserID(req))
+	}
+	if v := s.Get(req, "key"); v != nil {
+		t.Fatalf("expected the session to be reset but got %v", v)
+	}
+}
+
+func TestSessionLogoutManagedCookies(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32), Options{
+		FallbackNames:       []string{"_old_session"},
+		SeparateFlashCookie: true,
+	})
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.Login(rr, req, "42")
+	s.Flash(rr, req, "notice", "logged in")
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, cookie := range rr.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	req.AddCookie(&http.Cookie{Name: "_old_session", Value: "stale"})
+	req.AddCookie(&http.Cookie{Name: "other", Value: "value"})
+
+	expected := []string{"_session", "_old_session", "_session_flash"}
+	if names := s.ManagedCookieNames(req); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %v but got %v", expected, names)
+	}
+
+	rr = httptest.NewRecorder()
+	s.Logout(rr, req)
+
+	cookies := make(map[string]*http.Cookie)
+	counts := make(map[string]int)
+	for _, cookie := range rr.Result().Cookies() {
+		cookies[cookie.Name] = cookie
+		counts[cookie.Name]++
+	}
+	for _, name := range []string{"_old_session", "_session_flash"} {
+		if c, ok := cookies[name]; !ok || c.MaxAge != -1 {
+			t.Fatalf("expected cookie %s to be deleted but got %v", name, c)
+		}
+	}
+	for name, n := range counts {
+		if n != 1 {
+			t.Fatalf("expected cookie %s to be set once but got %d", name, n)
+		}
+	}
+	if _, ok := cookies["other"]; ok {
+		t.Fatal("expected unrelated cookie to be left as is")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies["_session"])
+	if s.IsAuthenticated(req) {
+		t.Fatal("expected session not to be authenticated after logout")
+	}
+}
+
+func TestSessionLogoutFallbackName(t *testing.T) {
+	t.Parallel()
+
+	secret := GenerateRandomKey(32)
+	old := New(secret, Options{Name: "_old_session"})
+	s := New(secret, Options{FallbackNames: []string{"_old_session"}})
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	old.Login(rr, req, "42")
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(rr.Result().Cookies()[0])
+
+	rr = httptest.NewRecorder()
+	s.Logout(rr, req)
+
+	if n := len(rr.Header()["Set-Cookie"]); n != 2 {
+		t.Fatalf("expected the session cookie to be set and the fallback cookie to be deleted once but got %v", rr.Header()["Set-Cookie"])
+	}
+}
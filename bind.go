@@ -0,0 +1,64 @@
+package sessions
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// checkBinding checks that the given session decoded from the request's
+// cookie is bound to the client that sent it, according to the BindFunc
+// option. A session bound to a different client is replaced with an empty
+// one.
+func (s *Session) checkBinding(r *http.Request, ss *session) *session {
+	if ss.cookie == nil || len(ss.Binding) == 0 {
+		return ss
+	}
+
+	binding := s.fingerprint(r)
+	if diff := bindingDiff(ss.Binding, binding); diff > s.bindTolerance {
+		s.logf(LevelWarning, "ignored session from cookie %s, since it belongs to a different client: %d of %d fingerprint components differ", ss.cookie.Name, diff, len(binding))
+		return &session{err: ErrClientMismatch, method: r.Method}
+	}
+	return ss
+}
+
+// bind binds the given session to the client that sent the given request
+// before the session is saved, if the BindFunc option is set. This binds
+// every saved session, including new ones, such as those created by Login,
+// and rebinds sessions whose fingerprint changed within the BindTolerance.
+func (s *Session) bind(r *http.Request, ss *session) {
+	if s.bindFunc != nil {
+		ss.Binding = s.fingerprint(r)
+	}
+}
+
+// fingerprint returns the HMACs of each "|" separated component of the
+// fingerprint of the client that sent the given request, which are stored in
+// the session instead of the fingerprint itself, since the session isn't
+// encrypted. The HMACs are keyed by the secret, so that components with few
+// possible values, such as a subnet, can't be found by hashing each of them.
+func (s *Session) fingerprint(r *http.Request) []string {
+	parts := strings.Split(s.bindFunc(r), "|")
+	hashes := make([]string, len(parts))
+	for i, part := range parts {
+		mac := hmac.New(sha256.New, s.bindKey)
+		mac.Write([]byte(part))
+		hashes[i] = base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:9])
+	}
+	return hashes
+}
+
+// bindingDiff returns the number of components of the given fingerprints
+// that differ, counting components that are missing from either one.
+func bindingDiff(a, b []string) int {
+	diff := max(len(a), len(b)) - min(len(a), len(b))
+	for i := 0; i < min(len(a), len(b)); i++ {
+		if a[i] != b[i] {
+			diff++
+		}
+	}
+	return diff
+}
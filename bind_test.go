@@ -0,0 +1,163 @@
+package sessions
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSessionBindFunc(t *testing.T) {
+	t.Parallel()
+
+	bindFunc := func(r *http.Request) string {
+		return r.UserAgent() + "|" + r.Header.Get("X-Subnet")
+	}
+
+	for _, tt := range []struct {
+		name      string
+		tolerance int
+		userAgent string
+		subnet    string
+		match     bool
+	}{
+		{"same client", 0, "browser", "10.0.0.0/24", true},
+		{"different subnet", 0, "browser", "10.0.1.0/24", false},
+		{"different subnet within tolerance", 1, "browser", "10.0.1.0/24", true},
+		{"different client within tolerance", 1, "curl", "10.0.1.0/24", false},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			buf := &bytes.Buffer{}
+			s := New(GenerateRandomKey(32), Options{
+				Logger:        log.New(buf, "", 0),
+				BindFunc:      bindFunc,
+				BindTolerance: tt.tolerance,
+			})
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("User-Agent", "browser")
+			req.Header.Set("X-Subnet", "10.0.0.0/24")
+			s.Set(rr, req, "key", "value")
+
+			req = httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			req.Header.Set("X-Subnet", tt.subnet)
+			req.AddCookie(rr.Result().Cookies()[0])
+
+			if verified := s.Verify(req); verified != tt.match {
+				t.Fatalf("expected Verify to report %t but got %t", tt.match, verified)
+			}
+
+			got := s.Get(req, "key")
+			if tt.match {
+				if got != "value" {
+					t.Fatalf("expected value but got %v", got)
+				}
+				if err := s.Err(req); err != nil {
+					t.Fatalf("expected no error but got %v", err)
+				}
+				return
+			}
+
+			if got != nil {
+				t.Fatalf("expected the session to be ignored but got %v", got)
+			}
+			if err := s.Err(req); !errors.Is(err, ErrClientMismatch) {
+				t.Fatalf("expected error %v but got %v", ErrClientMismatch, err)
+			}
+			if !strings.Contains(buf.String(), "[WARNING] ignored session from cookie _session, since it belongs to a different client") {
+				t.Fatalf("expected a warning to be logged but got %q", buf)
+			}
+		})
+	}
+}
+
+func TestSessionBindFuncRebinds(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32), Options{
+		BindFunc: func(r *http.Request) string {
+			return r.UserAgent() + "|" + r.Header.Get("X-Subnet")
+		},
+		BindTolerance: 1,
+	})
+
+	request := func(subnet string, cookie *http.Cookie) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("User-Agent", "browser")
+		req.Header.Set("X-Subnet", subnet)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		return req
+	}
+
+	// Each save binds the session to the client's latest fingerprint, so
+	// the subnet can keep changing one step at a time.
+	var cookie *http.Cookie
+	for _, subnet := range []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24"} {
+		rr := httptest.NewRecorder()
+		req := request(subnet, cookie)
+		if cookie != nil && s.Get(req, "key") != "value" {
+			t.Fatalf("expected the session to be accepted from subnet %s", subnet)
+		}
+		s.Set(rr, req, "key", "value")
+		cookie = rr.Result().Cookies()[0]
+	}
+}
+
+func TestSessionBindFuncLogin(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32), Options{
+		BindFunc: func(r *http.Request) string {
+			return r.UserAgent()
+		},
+	})
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("User-Agent", "browser")
+	s.Login(rr, req, "42")
+	cookie := rr.Result().Cookies()[0]
+
+	// The new session created by Login is bound to the client that logged
+	// in, so replaying its cookie from another client is rejected.
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("User-Agent", "attacker")
+	req.AddCookie(cookie)
+	if userID := s.UserID(req); userID != "" {
+		t.Fatalf("expected no user from another client but got %s", userID)
+	}
+	if err := s.Err(req); !errors.Is(err, ErrClientMismatch) {
+		t.Fatalf("expected error %v but got %v", ErrClientMismatch, err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("User-Agent", "browser")
+	req.AddCookie(cookie)
+	if userID := s.UserID(req); userID != "42" {
+		t.Fatalf("expected user 42 from the same client but got %q", userID)
+	}
+}
+
+func TestSessionFingerprintKeyed(t *testing.T) {
+	t.Parallel()
+
+	bindFunc := func(r *http.Request) string { return "10.0.0.0/24" }
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	a := New(GenerateRandomKey(32), Options{BindFunc: bindFunc}).fingerprint(req)
+	b := New(GenerateRandomKey(32), Options{BindFunc: bindFunc}).fingerprint(req)
+	if slices.Equal(a, b) {
+		t.Fatalf("expected fingerprints hashed with different secrets to differ but got %v", a)
+	}
+}
@@ -0,0 +1,69 @@
+package sessions
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// A CompatDecoder decodes session cookies that were set by the CookieStore
+// from github.com/gorilla/sessions. It allows migrating to this package
+// without invalidating existing sessions, by setting it as the
+// CompatDecoder option.
+//
+// Values stored under keys that aren't strings can't be represented by this
+// package's sessions, so they're dropped when a legacy session is decoded.
+// Any types stored in the legacy sessions must still be registered with gob,
+// although the types used by this package are registered when the decoder is
+// created.
+type CompatDecoder struct {
+	codecs []securecookie.Codec
+}
+
+// NewCompatDecoder creates a new CompatDecoder with the same key pairs that
+// were passed to gorilla/sessions' NewCookieStore.
+func NewCompatDecoder(keyPairs ...[]byte) *CompatDecoder {
+	registerGob()
+	return &CompatDecoder{codecs: securecookie.CodecsFromPairs(keyPairs...)}
+}
+
+// decode decodes a legacy session from the given cookie name and value.
+func (cd *CompatDecoder) decode(name, value string) (*session, error) {
+	values := make(map[interface{}]interface{})
+	if err := securecookie.DecodeMulti(name, value, &values, cd.codecs...); err != nil {
+		return nil, fmt.Errorf("failed to decode legacy session: %w", err)
+	}
+
+	ss := &session{Data: make(map[string]interface{}, len(values))}
+	for k, v := range values {
+		if key, ok := k.(string); ok {
+			ss.Data[key] = v
+		}
+	}
+	return ss, nil
+}
+
+// decodeLegacy decodes a session that can't be decoded by the session's own
+// codecs, using the FallbackCodecs and CompatDecoder options, and reports
+// whether the session was decoded.
+func (s *Session) decodeLegacy(name, value string) (*session, bool) {
+	for _, codec := range s.fallbackCodecs {
+		ss := &session{}
+		if err := codec.Decode(name, value, ss); err != nil {
+			continue
+		}
+		if !ss.Expires.IsZero() && !time.Now().Before(ss.Expires) {
+			continue
+		}
+		ss.upgrade()
+		return ss, true
+	}
+
+	if s.compat != nil {
+		if ss, err := s.compat.decode(name, value); err == nil {
+			return ss, true
+		}
+	}
+	return nil, false
+}
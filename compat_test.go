@@ -0,0 +1,97 @@
+package sessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+)
+
+func TestCompatDecoder(t *testing.T) {
+	t.Parallel()
+
+	key := GenerateRandomKey(32)
+	legacyKey := GenerateRandomKey(32)
+	s := New(key, Options{
+		CompatDecoder: NewCompatDecoder(legacyKey),
+	})
+
+	// Encode the session the same way gorilla/sessions' CookieStore does.
+	legacy, err := securecookie.EncodeMulti("_session", map[interface{}]interface{}{
+		"user": "alice",
+		1:      "dropped",
+	}, securecookie.CodecsFromPairs(legacyKey)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := s.TemplMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := s.Get(r, "user"); v != "alice" {
+			t.Errorf("expected legacy value alice but got %v", v)
+		}
+		if n := len(s.List(r)); n != 1 {
+			t.Errorf("expected 1 value but got %d", n)
+		}
+	}))
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "_session", Value: legacy})
+	h.ServeHTTP(rr, req)
+
+	// The legacy session is re-issued in the native format, even though the
+	// handler didn't change it.
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie but got %d", len(cookies))
+	}
+
+	native := New(key)
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[0])
+	if v := native.Get(req, "user"); v != "alice" {
+		t.Fatalf("expected native value alice but got %v", v)
+	}
+}
+
+func TestSessionFallbackCodecs(t *testing.T) {
+	t.Parallel()
+
+	key := GenerateRandomKey(32)
+
+	// The codec the sessions were previously encoded with uses JSON.
+	old := securecookie.New(key, nil)
+	old.SetSerializer(securecookie.JSONEncoder{})
+
+	s := New(key, Options{FallbackCodecs: []securecookie.Codec{old}})
+
+	legacy, err := old.Encode("_session", map[string]interface{}{
+		"Data": map[string]interface{}{"user": "alice"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := s.TemplMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := s.Get(r, "user"); v != "alice" {
+			t.Errorf("expected value from the old codec but got %v", v)
+		}
+	}))
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "_session", Value: legacy})
+	h.ServeHTTP(rr, req)
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie but got %d", len(cookies))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[0])
+	if v := New(key).Get(req, "user"); v != "alice" {
+		t.Fatalf("expected value re-issued with the new codec but got %v", v)
+	}
+}
@@ -0,0 +1,66 @@
+package sessions
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+)
+
+const (
+	// compressedMarker is the first byte of a serialized session that was
+	// compressed. CBOR encoded sessions begin with the header of a map, so an
+	// uncompressed session never begins with the marker.
+	compressedMarker = 0x01
+
+	// maxDecompressedSize is the maximum size in bytes of a decompressed
+	// session, which stops a small cookie from decompressing into a very
+	// large session.
+	maxDecompressedSize = 1 << 20
+)
+
+var errDecompressedTooLarge = errors.New("sessions: decompressed session is too large")
+
+// compress returns the given serialized session compressed with DEFLATE,
+// prefixed with the compressedMarker. The session is returned as is if it
+// doesn't get smaller.
+func compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(compressedMarker)
+
+	fw, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+
+	if buf.Len() >= len(b) {
+		return b, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// isCompressed reports whether the given serialized session was compressed.
+func isCompressed(b []byte) bool {
+	return len(b) > 0 && b[0] == compressedMarker
+}
+
+// decompress returns the given compressed session decompressed.
+func decompress(b []byte) ([]byte, error) {
+	fr := flate.NewReader(bytes.NewReader(b[1:]))
+	defer fr.Close()
+
+	out, err := io.ReadAll(io.LimitReader(fr, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxDecompressedSize {
+		return nil, errDecompressedTooLarge
+	}
+	return out, nil
+}
@@ -0,0 +1,78 @@
+package sessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSessionCompressThreshold(t *testing.T) {
+	t.Parallel()
+
+	secret := GenerateRandomKey(32)
+	large := strings.Repeat("compressible ", 100)
+
+	for _, tt := range []struct {
+		name       string
+		value      string
+		compressed bool
+	}{
+		{"below threshold", "small", false},
+		{"above threshold", large, true},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			cs := &cborSerializer{compressThreshold: 256}
+			b, err := cs.Serialize(&session{Data: map[string]interface{}{"key": tt.value}})
+			if err != nil {
+				t.Fatalf("expected no error but got %v", err)
+			}
+			if isCompressed(b) != tt.compressed {
+				t.Fatalf("expected compressed %t but got %t", tt.compressed, isCompressed(b))
+			}
+
+			ss := &session{}
+			if err := cs.Deserialize(b, ss); err != nil {
+				t.Fatalf("expected no error but got %v", err)
+			}
+			if got := ss.Data["key"]; got != tt.value {
+				t.Fatalf("expected %q but got %q", tt.value, got)
+			}
+		})
+	}
+
+	// A compressed cookie must be smaller, and readable by a session manager
+	// that never compresses.
+	cookieFor := func(s *Session) *http.Cookie {
+		rr := httptest.NewRecorder()
+		s.Set(rr, httptest.NewRequest(http.MethodGet, "/", nil), "key", large)
+		return rr.Result().Cookies()[0]
+	}
+	compressed := cookieFor(New(secret, Options{CompressThreshold: 256}))
+	uncompressed := cookieFor(New(secret))
+
+	if len(compressed.Value) >= len(uncompressed.Value) {
+		t.Fatalf("expected compressed cookie of %d bytes to be smaller than %d bytes", len(compressed.Value), len(uncompressed.Value))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(compressed)
+	if got, _ := New(secret).GetString(req, "key"); got != large {
+		t.Fatalf("expected %q but got %q", large, got)
+	}
+}
+
+func TestDecompressTooLarge(t *testing.T) {
+	t.Parallel()
+
+	b, err := compress(make([]byte, maxDecompressedSize+1))
+	if err != nil {
+		t.Fatalf("expected no error but got %v", err)
+	}
+	if _, err := decompress(b); err != errDecompressedTooLarge {
+		t.Fatalf("expected error %v but got %v", errDecompressedTooLarge, err)
+	}
+}
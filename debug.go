@@ -0,0 +1,128 @@
+package sessions
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+type debugCtxKeyType struct{}
+
+var debugCtxKey = debugCtxKeyType{}
+
+// accessLog records the session accesses made during a request.
+type accessLog struct {
+	mu     sync.Mutex
+	events []string
+}
+
+// DebugMiddleware logs every call to Get, Set, Delete, and Flash made by the
+// given handler, along with the size of the encoded session at the end of
+// the request.
+//
+// This middleware is intended for use during development only, to help find
+// where session data is read and written. Messages are logged at LevelDebug,
+// so the session's LogLevel must be set to LevelDebug for them to appear.
+func (s *Session) DebugMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		al := &accessLog{}
+		r = r.WithContext(context.WithValue(r.Context(), debugCtxKey, al))
+
+		next.ServeHTTP(w, r)
+
+		al.mu.Lock()
+		defer al.mu.Unlock()
+
+		for _, event := range al.events {
+			s.logf(LevelDebug, "%s %s: %s", r.Method, r.URL.Path, event)
+		}
+
+		encoded, err := s.encode(s.name, s.fromReq(r))
+		if err != nil {
+			s.logf(LevelDebug, "%s %s: failed to encode session: %v", r.Method, r.URL.Path, err)
+			return
+		}
+		s.logf(LevelDebug, "%s %s: encoded session is %d bytes", r.Method, r.URL.Path, len(encoded))
+	})
+}
+
+// trace records a session access for the DebugMiddleware, if it's in use.
+func trace(r *http.Request, op string, key string) {
+	al, ok := r.Context().Value(debugCtxKey).(*accessLog)
+	if !ok {
+		return
+	}
+
+	al.mu.Lock()
+	al.events = append(al.events, op+" "+key)
+	al.mu.Unlock()
+}
+
+// An Inspection describes the contents of a session, as returned by Inspect.
+type Inspection struct {
+	// Data describes each value of session data, in order of their keys.
+	Data []InspectedValue
+
+	// Flashes describes each flash message, in the order they were set.
+	Flashes []InspectedValue
+
+	// Size is the size in bytes of the session once it's encoded as a cookie
+	// value, including its flashes, or zero if it can't be encoded.
+	Size int
+}
+
+// An InspectedValue describes a single value of a session.
+type InspectedValue struct {
+	// Key is the value's key, as it's stored in the session.
+	Key string
+
+	// Type is the name of the value's type, such as "string" or
+	// "map[string]interface {}".
+	Type string
+
+	// Size is the size in bytes of the value once it's encoded, or zero if
+	// it can't be encoded.
+	Size int
+}
+
+// Inspect describes the data and flashes of the session from the given
+// request, along with their sizes, for example, to show in a debug panel
+// during development. Unlike Flashes, it doesn't clear the flash messages,
+// and it doesn't change the session in any other way.
+func (s *Session) Inspect(r *http.Request) Inspection {
+	data := s.fromReq(r)
+
+	keys := make([]string, 0, len(data.Data))
+	for k := range data.Data {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	var in Inspection
+	for _, k := range keys {
+		in.Data = append(in.Data, inspectValue(k, data.Data[k]))
+	}
+	for _, k := range data.flashOrder() {
+		in.Flashes = append(in.Flashes, inspectValue(k, data.Flashes[k]))
+	}
+
+	// Encode a copy of the session, since encoding sets its version.
+	cp := *data
+	if encoded, err := s.encode(s.name, &cp); err == nil {
+		in.Size = len(encoded)
+	}
+	return in
+}
+
+// inspectValue describes the given value with the given key.
+func inspectValue(key string, value interface{}) InspectedValue {
+	iv := InspectedValue{Key: key, Type: fmt.Sprintf("%T", value)}
+	if b, err := cbor.Marshal(value); err == nil {
+		iv.Size = len(b)
+	}
+	return iv
+}
@@ -0,0 +1,98 @@
+package sessions
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDebugMiddleware(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	s := New(GenerateRandomKey(32), Options{
+		Logger:   log.New(buf, "", 0),
+		LogLevel: LevelDebug,
+	})
+
+	h := s.DebugMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Get(r, "name")
+		s.Set(w, r, "name", "Ben")
+		s.Delete(w, r, "cart")
+		s.Flash(w, r, "notice", "Hello")
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	expected := []string{
+		"sessions: [DEBUG] GET /: get name",
+		"sessions: [DEBUG] GET /: set name",
+		"sessions: [DEBUG] GET /: delete cart",
+		"sessions: [DEBUG] GET /: flash notice",
+	}
+	if len(lines) != len(expected)+1 {
+		t.Fatalf("expected %d lines but got %q", len(expected)+1, lines)
+	}
+	for i, line := range expected {
+		if lines[i] != line {
+			t.Fatalf("expected %q but got %q", line, lines[i])
+		}
+	}
+	if last := lines[len(lines)-1]; !strings.HasPrefix(last, "sessions: [DEBUG] GET /: encoded session is ") {
+		t.Fatalf("expected encoded session size but got %q", last)
+	}
+}
+
+func TestSessionInspect(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.Set(rr, req, "name", "alice")
+	s.Set(rr, req, "bio", strings.Repeat("a", 100))
+	s.Set(rr, req, "visits", 3)
+	s.Flash(rr, req, "notice", "saved")
+	s.Flash(rr, req, "alert", "check your email")
+
+	cookies := rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+
+	in := s.Inspect(req)
+
+	var keys, types []string
+	sizes := make(map[string]int)
+	for _, v := range in.Data {
+		keys = append(keys, v.Key)
+		types = append(types, v.Type)
+		sizes[v.Key] = v.Size
+	}
+	if want := []string{"bio", "name", "visits"}; !slices.Equal(keys, want) {
+		t.Fatalf("expected data keys %v but got %v", want, keys)
+	}
+	if want := []string{"string", "string", "uint64"}; !slices.Equal(types, want) {
+		t.Fatalf("expected data types %v but got %v", want, types)
+	}
+	if !(sizes["bio"] > sizes["name"] && sizes["name"] > sizes["visits"]) {
+		t.Fatalf("expected bio to be larger than name, and name larger than visits, but got %v", sizes)
+	}
+
+	if len(in.Flashes) != 2 || in.Flashes[0].Key != "notice" || in.Flashes[1].Key != "alert" {
+		t.Fatalf("expected flashes notice and alert but got %+v", in.Flashes)
+	}
+	if in.Size != len(cookies[len(cookies)-1].Value) {
+		t.Fatalf("expected size %d but got %d", len(cookies[len(cookies)-1].Value), in.Size)
+	}
+
+	// Inspecting the session must not clear its flashes.
+	if flashes := s.Flashes(httptest.NewRecorder(), req); len(flashes) != 2 {
+		t.Fatalf("expected 2 flashes after inspecting but got %d", len(flashes))
+	}
+}
@@ -0,0 +1,101 @@
+package sessions
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+)
+
+var (
+	// ErrTampered is returned when a session cookie's signature is invalid,
+	// which means its value was tampered with or it was signed using a key
+	// that is no longer in use.
+	ErrTampered = errors.New("sessions: session cookie signature is invalid")
+
+	// ErrExpired is returned when a session cookie is older than its maximum
+	// age.
+	ErrExpired = errors.New("sessions: session cookie has expired")
+
+	// ErrMalformed is returned when a session cookie's value could not be
+	// decoded.
+	ErrMalformed = errors.New("sessions: session cookie is malformed")
+
+	// ErrInvalidKey is returned when a key is empty, too long, or begins with
+	// a prefix reserved for use by the library.
+	ErrInvalidKey = errors.New("sessions: invalid key")
+
+	// ErrTooManyKeys is returned when adding a key would exceed the maximum
+	// number of keys set by the MaxKeys option.
+	ErrTooManyKeys = errors.New("sessions: too many keys")
+
+	// ErrValueTooLarge is returned when a value is larger than the maximum
+	// size set by the MaxValueSize option.
+	ErrValueTooLarge = errors.New("sessions: value too large")
+
+	// ErrResponseWritten is returned when the session cookie can't be set
+	// because the response has already been written.
+	ErrResponseWritten = errors.New("sessions: response was already written")
+
+	// ErrInvalidOptions is returned when the options passed to NewWithError
+	// are invalid.
+	ErrInvalidOptions = errors.New("sessions: invalid options")
+
+	// ErrClientMismatch is returned when a session cookie was bound by the
+	// BindFunc option to a client that differs from the one that sent it.
+	ErrClientMismatch = errors.New("sessions: session cookie belongs to a different client")
+
+	// ErrNotMap is returned by TrySetPath when a component of the path other
+	// than the last one refers to a value that isn't a map.
+	ErrNotMap = errors.New("sessions: value is not a map")
+)
+
+// errSessionExpired is returned when a session has passed the expiry set by
+// SetExpiry.
+var errSessionExpired = fmt.Errorf("%w: session expired", ErrExpired)
+
+// securecookie does not export its timestamp errors, so they're identified
+// by their messages instead.
+const (
+	errTimestampExpired = "securecookie: expired timestamp"
+	errTimestampTooNew  = "securecookie: timestamp is too new"
+	errValueTooLong     = "securecookie: the value is too long: "
+)
+
+// tooLongLength returns the length of the encoded value from an error
+// returned by securecookie when encoding a value that is longer than the
+// codec's maximum length, and whether the error is of that kind.
+func tooLongLength(err error) (int, bool) {
+	msg, ok := strings.CutPrefix(err.Error(), errValueTooLong)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(msg)
+	return n, err == nil
+}
+
+// classifyError wraps an error returned by securecookie when decoding a
+// cookie with one of ErrTampered, ErrExpired, or ErrMalformed. Usage and
+// internal errors, such as a missing hash key, are returned as is.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, securecookie.ErrMacInvalid) {
+		return fmt.Errorf("%w: %v", ErrTampered, err)
+	}
+
+	switch err.Error() {
+	case errTimestampExpired, errTimestampTooNew:
+		return fmt.Errorf("%w: %v", ErrExpired, err)
+	}
+
+	var scErr securecookie.Error
+	if errors.As(err, &scErr) && (scErr.IsUsage() || scErr.IsInternal()) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrMalformed, err)
+}
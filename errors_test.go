@@ -0,0 +1,98 @@
+package sessions
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// encodeAt encodes the session in the same format as securecookie, but with
+// the given timestamp, since securecookie does not allow overriding the time
+// that a cookie is encoded at.
+func encodeAt(t *testing.T, secret []byte, name string, ss *session, at time.Time) string {
+	t.Helper()
+
+	b, err := cbor.Marshal(ss)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := fmt.Sprintf("%s|%d|%s", name, at.Unix(), base64.URLEncoding.EncodeToString(b))
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(value))
+	value = value[len(name)+1:] + "|" + string(h.Sum(nil))
+
+	return base64.URLEncoding.EncodeToString([]byte(value))
+}
+
+func TestSessionErr(t *testing.T) {
+	t.Parallel()
+
+	secret := GenerateRandomKey(32)
+	s := New(secret, Options{Quiet: true})
+
+	// Create a cookie signed with a different key.
+	rr := httptest.NewRecorder()
+	New(GenerateRandomKey(32)).Set(rr, httptest.NewRequest(http.MethodGet, "/", nil), "key", "value")
+	tampered := rr.Result().Cookies()[0].Value
+
+	cases := []struct {
+		name     string
+		value    string
+		expected error
+	}{
+		{
+			name:     "a valid cookie has no error",
+			value:    encodeAt(t, secret, "_session", &session{}, time.Now()),
+			expected: nil,
+		},
+		{
+			name:     "a cookie signed with a different key is tampered",
+			value:    tampered,
+			expected: ErrTampered,
+		},
+		{
+			name:     "a cookie older than the max age is expired",
+			value:    encodeAt(t, secret, "_session", &session{}, time.Now().Add(-2*defaultMaxAge*time.Second)),
+			expected: ErrExpired,
+		},
+		{
+			name:     "a cookie that isn't base64 encoded is malformed",
+			value:    "not base64!",
+			expected: ErrMalformed,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.AddCookie(&http.Cookie{Name: "_session", Value: c.value})
+
+			err := s.Err(req)
+			if c.expected == nil {
+				if err != nil {
+					t.Fatalf("expected no error but got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, c.expected) {
+				t.Fatalf("expected %v but got %v", c.expected, err)
+			}
+		})
+	}
+
+	t.Run("a request without a cookie has no error", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if err := s.Err(req); err != nil {
+			t.Fatalf("expected no error but got %v", err)
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package sessions
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// A Key is a typed session key. Values set and read using the key are always
+// of type T, which prevents typos in key names and mismatched value types
+// from going unnoticed until runtime.
+//
+// Keys are stored by their name in the same session data as untyped keys,
+// so a Key and a string key with the same name refer to the same value.
+type Key[T any] struct {
+	name string
+}
+
+// NewKey creates a new typed session key with the given name.
+func NewKey[T any](name string) Key[T] {
+	return Key[T]{name: name}
+}
+
+// Name returns the name of the key.
+func (k Key[T]) Name() string {
+	return k.name
+}
+
+// SetKey sets or updates the value for the given typed key on the session.
+func SetKey[T any](s *Session, w http.ResponseWriter, r *http.Request, key Key[T], value T) {
+	s.Set(w, r, key.name, value)
+}
+
+// GetKey returns the value for the given typed key from the session. If the
+// key is not present, or its value is not of type T, GetKey returns the zero
+// value of T and false.
+func GetKey[T any](s *Session, r *http.Request, key Key[T]) (T, bool) {
+	return valueOf[T](s.Get(r, key.name))
+}
+
+// DeleteKey deletes and returns the value for the given typed key from the
+// session. If the key was not present, or its value was not of type T,
+// DeleteKey returns the zero value of T and false.
+func DeleteKey[T any](s *Session, w http.ResponseWriter, r *http.Request, key Key[T]) (T, bool) {
+	return valueOf[T](s.Delete(w, r, key.name))
+}
+
+// GetOr returns the session value for the given key as type T, or def if the
+// key is not present or its value is not of type T.
+func GetOr[T any](s *Session, r *http.Request, key string, def T) T {
+	if v, ok := valueOf[T](s.Get(r, key)); ok {
+		return v
+	}
+	return def
+}
+
+// FlashesOf returns the flashes whose values are of type T, and clears all
+// of the flashes from the session, including those that aren't of type T.
+func FlashesOf[T any](s *Session, w http.ResponseWriter, r *http.Request) map[string]T {
+	flashes := s.Flashes(w, r)
+	values := make(map[string]T, len(flashes))
+	for k, v := range flashes {
+		if tv, ok := valueOf[T](v); ok {
+			values[k] = tv
+		}
+	}
+	return values
+}
+
+// PopFlashOf removes and returns the flash for the given key as type T. If
+// the flash is not present, or its value is not of type T, PopFlashOf returns
+// the zero value of T and false, and the flash is left as is. The session is
+// only saved when the flash is removed.
+func PopFlashOf[T any](s *Session, w http.ResponseWriter, r *http.Request, key string) (T, bool) {
+	data := s.fromReq(r)
+	v, ok := valueOf[T](data.Flashes[key])
+	if !ok {
+		return v, false
+	}
+
+	delete(data.Flashes, key)
+	data.RedirectFlashes = slices.DeleteFunc(data.RedirectFlashes, func(k string) bool {
+		return k == key
+	})
+	s.saveFlashCtx(w, r, data)
+	return v, true
+}
+
+// valueOf returns v as a value of type T, and whether or not the conversion
+// succeeded.
+//
+// Session data decoded from a cookie doesn't always have the same type as
+// when it was set, for example, an int is decoded as a uint64. When the
+// value can't be asserted to T, it's converted by encoding and decoding it
+// into a value of type T.
+func valueOf[T any](v interface{}) (T, bool) {
+	var t T
+	if v == nil {
+		return t, false
+	}
+	if tv, ok := v.(T); ok {
+		return tv, true
+	}
+
+	b, err := cbor.Marshal(v)
+	if err != nil {
+		return t, false
+	}
+	if err := cbor.Unmarshal(b, &t); err != nil {
+		return t, false
+	}
+	return t, true
+}
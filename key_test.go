@@ -0,0 +1,161 @@
+package sessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKey(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+
+	userID := NewKey[int]("user_id")
+	username := NewKey[string]("username")
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	SetKey(s, rr, req, userID, 42)
+	SetKey(s, rr, req, username, "ben")
+
+	// Read the values back from the cookie, since integers aren't decoded
+	// with the same type.
+	cookies := rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+
+	if v, ok := GetKey(s, req, userID); !ok || v != 42 {
+		t.Fatalf("expected 42 but got %v, %t", v, ok)
+	}
+	if v, ok := GetKey(s, req, username); !ok || v != "ben" {
+		t.Fatalf("expected ben but got %v, %t", v, ok)
+	}
+
+	rr = httptest.NewRecorder()
+	if v, ok := DeleteKey(s, rr, req, userID); !ok || v != 42 {
+		t.Fatalf("expected deleted value to be 42 but got %v, %t", v, ok)
+	}
+	if v, ok := GetKey(s, req, userID); ok || v != 0 {
+		t.Fatalf("expected deleted key to be missing but got %v, %t", v, ok)
+	}
+}
+
+func TestKeyTypeMismatch(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	// Two keys with the same name but different types.
+	count := NewKey[int]("count")
+	label := NewKey[string]("count")
+
+	SetKey(s, rr, req, label, "many")
+
+	if v, ok := GetKey(s, req, count); ok || v != 0 {
+		t.Fatalf("expected type mismatch to return the zero value but got %v, %t", v, ok)
+	}
+	if v, ok := GetKey(s, req, label); !ok || v != "many" {
+		t.Fatalf("expected many but got %v, %t", v, ok)
+	}
+}
+
+func TestFlashesOf(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Flash(rr, req, "notice", "saved")
+	s.Flash(rr, req, "alert", "failed")
+	s.Flash(rr, req, "count", 3)
+
+	cookies := rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+
+	flashes := FlashesOf[string](s, httptest.NewRecorder(), req)
+	if len(flashes) != 2 || flashes["notice"] != "saved" || flashes["alert"] != "failed" {
+		t.Fatalf("expected only the string flashes but got %v", flashes)
+	}
+	if flashes := s.Flashes(httptest.NewRecorder(), req); len(flashes) != 0 {
+		t.Fatalf("expected all flashes to be cleared but got %v", flashes)
+	}
+}
+
+func TestPopFlashOf(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Flash(rr, req, "notice", "saved")
+	s.Flash(rr, req, "count", 3)
+
+	cookies := rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+
+	// A miss doesn't set a cookie.
+	rr = httptest.NewRecorder()
+	if v, ok := PopFlashOf[string](s, rr, req, "missing"); ok || v != "" {
+		t.Fatalf("expected miss to return the zero value but got %q, %t", v, ok)
+	}
+	if h := rr.Header().Get("Set-Cookie"); h != "" {
+		t.Fatalf("expected no Set-Cookie header on miss but got %s", h)
+	}
+
+	// A type mismatch leaves the flash in place.
+	if v, ok := PopFlashOf[string](s, rr, req, "count"); ok || v != "" {
+		t.Fatalf("expected type mismatch to return the zero value but got %q, %t", v, ok)
+	}
+	if h := rr.Header().Get("Set-Cookie"); h != "" {
+		t.Fatalf("expected no Set-Cookie header on type mismatch but got %s", h)
+	}
+
+	rr = httptest.NewRecorder()
+	if v, ok := PopFlashOf[string](s, rr, req, "notice"); !ok || v != "saved" {
+		t.Fatalf("expected saved but got %q, %t", v, ok)
+	}
+	if h := rr.Header().Get("Set-Cookie"); h == "" {
+		t.Fatal("expected Set-Cookie header on hit")
+	}
+
+	cookies = rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+	flashes := s.Flashes(httptest.NewRecorder(), req)
+	if _, ok := flashes["notice"]; ok || len(flashes) != 1 {
+		t.Fatalf("expected only the count flash to remain but got %v", flashes)
+	}
+}
+
+func TestGetOr(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Set(rr, req, "per_page", 25)
+	s.Set(rr, req, "label", "many")
+
+	cookies := rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+
+	if v := GetOr(s, req, "per_page", 10); v != 25 {
+		t.Fatalf("expected stored value 25 but got %d", v)
+	}
+	if v := GetOr(s, req, "label", 10); v != 10 {
+		t.Fatalf("expected default for mismatched type but got %d", v)
+	}
+	if v := GetOr(s, req, "missing", 10); v != 10 {
+		t.Fatalf("expected default for missing key but got %d", v)
+	}
+}
@@ -0,0 +1,128 @@
+package sessions
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxLimitedErrors is the number of distinct errors that an errorLimiter
+// keeps track of, so that errors with many different messages can't grow it
+// without bound.
+const maxLimitedErrors = 128
+
+// A LogLevel is the severity of a message logged by the library.
+type LogLevel int
+
+const (
+	// LevelDebug is used for messages that are only useful when debugging.
+	LevelDebug LogLevel = iota - 1
+
+	// LevelWarning is used for messages about likely misuse of the library.
+	// It is the zero value, and therefore the default log level.
+	LevelWarning
+
+	// LevelError is used for messages about failures to read or write
+	// session data.
+	LevelError
+)
+
+// String returns the name of the level used in log messages.
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelWarning:
+		return "WARNING"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// logf logs the formatted message at the given level, unless the session is
+// quiet or the level is below the configured log level.
+func (s *Session) logf(level LogLevel, format string, args ...interface{}) {
+	if s.quiet || level < s.logLevel {
+		return
+	}
+	s.logger.Printf("%s[%s] %s", s.logPrefix, level, fmt.Sprintf(format, args...))
+}
+
+// logError logs the given error at the error level. Errors returned by the
+// package start with "sessions: ", which is dropped since the log prefix
+// already names the package.
+func (s *Session) logError(err error) {
+	s.logf(LevelError, "%s", strings.TrimPrefix(err.Error(), "sessions: "))
+}
+
+// logLimitedf is like logf, but logs an error with the same message as one
+// logged within the DecodeErrorInterval option at most once, along with the
+// number of times it was suppressed. It's used for errors that can be caused
+// by every request of a single client, such as an undecodable cookie.
+func (s *Session) logLimitedf(level LogLevel, format string, err error) {
+	if s.quiet || level < s.logLevel {
+		return
+	}
+
+	msg := fmt.Sprintf(format, err)
+	suppressed, ok := s.decodeErrors.allow(msg, time.Now())
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		msg = fmt.Sprintf("%s (suppressed %d times)", msg, suppressed)
+	}
+	s.logger.Printf("%s[%s] %s", s.logPrefix, level, msg)
+}
+
+// An errorLimiter limits how often the same error message is logged.
+type errorLimiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	seen map[string]*limitedError
+}
+
+// A limitedError is an error message that has been logged.
+type limitedError struct {
+	logged     time.Time // When the message was last logged.
+	suppressed int       // Times the message wasn't logged since.
+}
+
+// allow reports whether the given message may be logged at the given time,
+// and how many times it wasn't logged since it was last logged. A nil
+// errorLimiter, or one with an interval that isn't positive, allows every
+// message.
+func (l *errorLimiter) allow(msg string, now time.Time) (suppressed int, ok bool) {
+	if l == nil || l.interval <= 0 {
+		return 0, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.seen[msg]; ok {
+		if now.Sub(e.logged) < l.interval {
+			e.suppressed++
+			return 0, false
+		}
+		suppressed = e.suppressed
+		e.logged, e.suppressed = now, 0
+		return suppressed, true
+	}
+
+	if len(l.seen) >= maxLimitedErrors {
+		for k, e := range l.seen {
+			if now.Sub(e.logged) >= l.interval {
+				delete(l.seen, k)
+			}
+		}
+		if len(l.seen) >= maxLimitedErrors {
+			return 0, true
+		}
+	}
+	l.seen[msg] = &limitedError{logged: now}
+	return 0, true
+}
@@ -0,0 +1,133 @@
+package sessions
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionLogLevel(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	s := New(GenerateRandomKey(32), Options{
+		Logger:    log.New(buf, "", 0),
+		LogPrefix: "app: ",
+		LogLevel:  LevelError,
+	})
+
+	// Log a warning by reading flashes without the middleware.
+	s.FlashesCtx(context.Background())
+
+	// Log an error by reading a session from an invalid cookie.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "_session", Value: "invalid"})
+	s.Get(req, "key")
+
+	logs := buf.String()
+	if strings.Contains(logs, "[WARNING]") {
+		t.Fatalf("expected warnings to be suppressed but got %q", logs)
+	}
+	if !strings.HasPrefix(logs, "app: [ERROR] failed to decode session from cookie") {
+		t.Fatalf("expected error to be logged but got %q", logs)
+	}
+}
+
+func TestSessionLogQuiet(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	s := New(GenerateRandomKey(32), Options{
+		Logger:   log.New(buf, "", 0),
+		LogLevel: LevelDebug,
+		Quiet:    true,
+	})
+
+	s.FlashesCtx(context.Background())
+
+	if buf.Len() != 0 {
+		t.Fatalf("expected nothing to be logged but got %q", buf)
+	}
+}
+
+func TestSessionLogWrittenResponse(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	s := New(GenerateRandomKey(32), Options{Logger: log.New(buf, "", 0)})
+
+	h := s.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, world!"))
+		s.Set(w, r, "key", "value")
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if logs := buf.String(); !strings.HasPrefix(logs, "sessions: [WARNING] session was modified after the response was written") {
+		t.Fatalf("expected warning to be logged but got %q", logs)
+	}
+	if h := rr.Result().Header.Get("Set-Cookie"); h != "" {
+		t.Fatalf("expected no Set-Cookie header but got %s", h)
+	}
+}
+
+func TestSessionLogDecodeErrorInterval(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		interval time.Duration
+		want     int
+	}{
+		{0, 1},
+		{-1, 100},
+	} {
+		buf := &bytes.Buffer{}
+		s := New(GenerateRandomKey(32), Options{
+			Logger:              log.New(buf, "", 0),
+			DecodeErrorInterval: tt.interval,
+		})
+
+		for i := 0; i < 100; i++ {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.AddCookie(&http.Cookie{Name: "_session", Value: "invalid"})
+			s.Get(req, "key")
+		}
+
+		if got := strings.Count(buf.String(), "failed to decode session from cookie"); got != tt.want {
+			t.Fatalf("expected %d decode errors to be logged with interval %s but got %d", tt.want, tt.interval, got)
+		}
+	}
+}
+
+func TestErrorLimiter(t *testing.T) {
+	t.Parallel()
+
+	l := &errorLimiter{interval: time.Minute, seen: make(map[string]*limitedError)}
+	now := time.Now()
+
+	if _, ok := l.allow("a", now); !ok {
+		t.Fatal("expected the first message to be allowed")
+	}
+	if _, ok := l.allow("b", now); !ok {
+		t.Fatal("expected a different message to be allowed")
+	}
+	for i := 0; i < 3; i++ {
+		if _, ok := l.allow("a", now.Add(time.Second)); ok {
+			t.Fatal("expected a repeated message to be suppressed")
+		}
+	}
+
+	suppressed, ok := l.allow("a", now.Add(time.Minute))
+	if !ok {
+		t.Fatal("expected the message to be allowed once the interval passed")
+	}
+	if suppressed != 3 {
+		t.Fatalf("expected 3 suppressed messages but got %d", suppressed)
+	}
+}
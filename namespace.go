@@ -0,0 +1,99 @@
+package sessions
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// A Namespace provides access to a group of session values that are stored
+// together under a single key in the session data, such that the values of
+// one namespace are kept separate from those of another.
+type Namespace struct {
+	s    *Session
+	name string
+}
+
+// Namespace returns a namespace whose values are stored under the given
+// name in the session data.
+func (s *Session) Namespace(name string) *Namespace {
+	return &Namespace{s: s, name: s.dataKey(name)}
+}
+
+// values returns the namespace's map of values from the session, which is nil
+// if the namespace has no values.
+func (ns *Namespace) values(data *session) map[string]interface{} {
+	values, _ := asMap(data.Data[ns.name])
+	return values
+}
+
+// Get returns the namespace's value for the given key.
+func (ns *Namespace) Get(r *http.Request, key string) interface{} {
+	return ns.values(ns.s.fromReq(r))[key]
+}
+
+// List returns all key value pairs in the namespace.
+func (ns *Namespace) List(r *http.Request) map[string]interface{} {
+	values := make(map[string]interface{})
+	for k, v := range ns.values(ns.s.fromReq(r)) {
+		values[k] = v
+	}
+	return values
+}
+
+// Set sets or updates the given value in the namespace.
+func (ns *Namespace) Set(w http.ResponseWriter, r *http.Request, key string, value interface{}) {
+	data := ns.s.fromReq(r)
+	if err := ns.s.checkMaxKeys(data, ns.name); err != nil {
+		ns.s.logf(LevelError, "failed to set session value: %v", err)
+		return
+	}
+	data.init()
+
+	values := ns.values(data)
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+	values[key] = value
+	data.Data[ns.name] = values
+
+	ns.s.saveCtx(w, r, data)
+}
+
+// Delete deletes and returns the namespace's value for the given key.
+func (ns *Namespace) Delete(w http.ResponseWriter, r *http.Request, key string) interface{} {
+	data := ns.s.fromReq(r)
+	values := ns.values(data)
+	value := values[key]
+	delete(values, key)
+	if values != nil {
+		data.Data[ns.name] = values
+	}
+
+	ns.s.saveCtx(w, r, data)
+	return value
+}
+
+// Clear deletes all values in the namespace, leaving the rest of the session
+// as is.
+func (ns *Namespace) Clear(w http.ResponseWriter, r *http.Request) {
+	data := ns.s.fromReq(r)
+	delete(data.Data, ns.name)
+	ns.s.saveCtx(w, r, data)
+}
+
+// asMap returns v as a map with string keys. Maps stored in the session are
+// decoded from the cookie with interface{} keys, so those are converted to
+// string keys.
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		values := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			values[fmt.Sprint(k)] = v
+		}
+		return values, true
+	}
+	return nil, false
+}
@@ -0,0 +1,72 @@
+package sessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNamespace(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	cart := s.Namespace("cart")
+	prefs := s.Namespace("prefs")
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	cart.Set(rr, req, "items", "3")
+	prefs.Set(rr, req, "items", "10")
+	prefs.Set(rr, req, "theme", "dark")
+
+	// Read the namespaces back from the cookie.
+	cookies := rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+
+	if v := cart.Get(req, "items"); v != "3" {
+		t.Fatalf("expected 3 but got %v", v)
+	}
+	if v := prefs.Get(req, "items"); v != "10" {
+		t.Fatalf("expected 10 but got %v", v)
+	}
+	if v := s.Get(req, "items"); v != nil {
+		t.Fatalf("expected namespaced key not to be set on the session but got %v", v)
+	}
+
+	rr = httptest.NewRecorder()
+	if v := prefs.Delete(rr, req, "theme"); v != "dark" {
+		t.Fatalf("expected deleted value to be dark but got %v", v)
+	}
+	if values := prefs.List(req); len(values) != 1 {
+		t.Fatalf("expected 1 value but got %v", values)
+	}
+}
+
+func TestNamespaceClear(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	cart := s.Namespace("cart")
+	prefs := s.Namespace("prefs")
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Set(rr, req, "user_id", "1")
+	cart.Set(rr, req, "items", "3")
+	prefs.Set(rr, req, "theme", "dark")
+
+	cart.Clear(rr, req)
+
+	if values := cart.List(req); len(values) != 0 {
+		t.Fatalf("expected cart to be empty but got %v", values)
+	}
+	if v := prefs.Get(req, "theme"); v != "dark" {
+		t.Fatalf("expected dark but got %v", v)
+	}
+	if v := s.Get(req, "user_id"); v != "1" {
+		t.Fatalf("expected 1 but got %v", v)
+	}
+}
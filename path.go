@@ -0,0 +1,92 @@
+package sessions
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// GetPath returns the value at the given dotted path in the session, such as
+// "prefs.ui.theme", where each component of the path but the last is a
+// nested map. It reports whether the value was found, which it isn't if any
+// component is missing or isn't a map.
+func (s *Session) GetPath(r *http.Request, path string) (interface{}, bool) {
+	parts := strings.Split(path, ".")
+	value := s.Get(r, parts[0])
+	if value == nil && !s.Has(r, parts[0]) {
+		return nil, false
+	}
+
+	for _, part := range parts[1:] {
+		m, ok := asMap(value)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// SetPath sets the value at the given dotted path in the session, such as
+// "prefs.ui.theme", creating any missing nested maps along the way. Like Set,
+// any error is logged rather than returned.
+func (s *Session) SetPath(w http.ResponseWriter, r *http.Request, path string, value interface{}) {
+	if err := s.TrySetPath(w, r, path, value); err != nil {
+		s.logf(LevelError, "failed to set session value: %v", err)
+	}
+}
+
+// TrySetPath is like SetPath, but returns an error if the value can't be
+// set. If a component of the path other than the last one refers to a value
+// that isn't a map, an error wrapping ErrNotMap is returned and the session
+// is left as is.
+func (s *Session) TrySetPath(w http.ResponseWriter, r *http.Request, path string, value interface{}) error {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[1:] {
+		if part == "" {
+			return fmt.Errorf("%w: path %q has an empty component", ErrInvalidKey, path)
+		}
+	}
+	if len(parts) == 1 {
+		return s.TrySet(w, r, path, value)
+	}
+
+	// Copy each of the maps along the path rather than modifying them in
+	// place, so that the session is only changed once the new value is set.
+	root, err := pathMap(s.Get(r, parts[0]), parts[0])
+	if err != nil {
+		return err
+	}
+	m := root
+	for i, part := range parts[1 : len(parts)-1] {
+		child, err := pathMap(m[part], strings.Join(parts[:i+2], "."))
+		if err != nil {
+			return err
+		}
+		m[part] = child
+		m = child
+	}
+	m[parts[len(parts)-1]] = value
+
+	return s.TrySet(w, r, parts[0], root)
+}
+
+// pathMap returns a copy of the given value at the given path as a map, or a
+// new map if the value is nil.
+func pathMap(v interface{}, path string) (map[string]interface{}, error) {
+	if v == nil {
+		return make(map[string]interface{}), nil
+	}
+
+	m, ok := asMap(v)
+	if !ok {
+		return nil, fmt.Errorf("%w: value at %q is of type %T", ErrNotMap, path, v)
+	}
+	values := make(map[string]interface{}, len(m)+1)
+	for k, v := range m {
+		values[k] = v
+	}
+	return values, nil
+}
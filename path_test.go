@@ -0,0 +1,70 @@
+package sessions
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSessionPath(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.Set(rr, req, "prefs", map[string]interface{}{
+		"ui": map[string]interface{}{"theme": "dark"},
+	})
+	s.SetPath(rr, req, "prefs.ui.font", "mono")
+	s.SetPath(rr, req, "deep.a.b.c", "value")
+
+	// Read the nested values back from the cookie, which decodes nested maps
+	// with keys of type interface{}.
+	cookies := rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+
+	for path, want := range map[string]interface{}{
+		"prefs.ui.theme": "dark",
+		"prefs.ui.font":  "mono",
+		"deep.a.b.c":     "value",
+	} {
+		if got, ok := s.GetPath(req, path); !ok || got != want {
+			t.Fatalf("expected %v at %s but got %v", want, path, got)
+		}
+	}
+
+	for _, path := range []string{"prefs.ui.missing", "prefs.ui.theme.color", "missing.path"} {
+		if got, ok := s.GetPath(req, path); ok {
+			t.Fatalf("expected no value at %s but got %v", path, got)
+		}
+	}
+
+	if _, ok := s.GetPath(req, "deep.a"); !ok {
+		t.Fatal("expected a map at deep.a")
+	}
+}
+
+func TestSessionSetPathNotMap(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.SetPath(rr, req, "prefs.ui.theme", "dark")
+
+	err := s.TrySetPath(rr, req, "prefs.ui.theme.color", "blue")
+	if !errors.Is(err, ErrNotMap) {
+		t.Fatalf("expected error %v but got %v", ErrNotMap, err)
+	}
+	if got, _ := s.GetPath(req, "prefs.ui.theme"); got != "dark" {
+		t.Fatalf("expected dark but got %v", got)
+	}
+
+	if err := s.TrySetPath(rr, req, "prefs..theme", "dark"); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("expected error %v but got %v", ErrInvalidKey, err)
+	}
+}
@@ -0,0 +1,93 @@
+package sessions
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A CookiePolicy describes the attributes that the session cookie is set
+// with.
+type CookiePolicy struct {
+	// Name is the name of the session cookie.
+	Name string
+
+	// Prefix is the cookie name prefix that browsers enforce additional
+	// restrictions for, either "__Host-" or "__Secure-", or empty if the name
+	// has neither prefix.
+	Prefix string
+
+	// Path is the path attribute of the session cookie.
+	Path string
+
+	// Domain is the domain attribute of the session cookie, or empty if the
+	// cookie is restricted to the host that set it.
+	Domain string
+
+	// Secure reports whether the session cookie is only sent over HTTPS.
+	Secure bool
+
+	// HttpOnly reports whether the session cookie is inaccessible to
+	// JavaScript.
+	HttpOnly bool
+
+	// SameSite is the SameSite attribute of the session cookie.
+	SameSite http.SameSite
+
+	// MaxAge is the lifetime of the session cookie when the session doesn't
+	// have its own expiry set with SetExpiry.
+	MaxAge time.Duration
+}
+
+// SecureDefaults returns options with hardened settings for production. The
+// cookie is named with the __Host- prefix, which browsers only accept for
+// secure cookies without a domain, and expires after 30 minutes of
+// inactivity. Under the Middleware or TemplMiddleware, sessions that are only
+// read are saved again once they're 15 minutes old, so that the cookie only
+// expires when the session isn't used for 30 minutes. Empty sessions delete
+// the cookie. The cookie is always HttpOnly and SameSite=Lax.
+//
+// Any of the returned options can be changed before passing them to New.
+func SecureDefaults() Options {
+	return Options{
+		Name:            "__Host-session",
+		MaxAge:          30 * 60,
+		RefreshAfter:    15 * 60,
+		DeleteWhenEmpty: true,
+	}
+}
+
+// DevDefaults returns options for local development, where the cookie is
+// set without the Secure attribute so that it's sent over plain HTTP. They
+// must never be used in production.
+//
+// Any of the returned options can be changed before passing them to New.
+func DevDefaults() Options {
+	return Options{
+		Insecure: true,
+	}
+}
+
+// CookiePolicy returns the attributes that the session cookie is set with,
+// which can be used to check that the cookie meets a security policy without
+// parsing the Set-Cookie header.
+func (s *Session) CookiePolicy() CookiePolicy {
+	var prefix string
+	for _, p := range []string{"__Host-", "__Secure-"} {
+		if strings.HasPrefix(s.name, p) {
+			prefix = p
+			break
+		}
+	}
+
+	return CookiePolicy{
+		Name:     s.name,
+		Prefix:   prefix,
+		Path:     "/",
+		Domain:   s.domain,
+		Secure:   !s.insecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   time.Duration(s.maxAge) * time.Second,
+	}
+}
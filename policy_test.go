@@ -0,0 +1,169 @@
+package sessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSessionCookiePolicy(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32), Options{Name: "__Host-session"})
+
+	policy := s.CookiePolicy()
+	want := CookiePolicy{
+		Name:     "__Host-session",
+		Prefix:   "__Host-",
+		Path:     "/",
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   365 * 24 * time.Hour,
+	}
+	if policy != want {
+		t.Fatalf("expected policy %+v but got %+v", want, policy)
+	}
+
+	// The policy must match the cookie that is actually set.
+	rr := httptest.NewRecorder()
+	s.Set(rr, httptest.NewRequest(http.MethodGet, "/", nil), "key", "value")
+	cookie := rr.Result().Cookies()[0]
+
+	if cookie.Name != policy.Name {
+		t.Fatalf("expected cookie name %s but got %s", policy.Name, cookie.Name)
+	}
+	if cookie.Path != policy.Path {
+		t.Fatalf("expected cookie path %s but got %s", policy.Path, cookie.Path)
+	}
+	if cookie.Secure != policy.Secure || cookie.HttpOnly != policy.HttpOnly {
+		t.Fatalf("expected secure %t and http only %t but got %t and %t", policy.Secure, policy.HttpOnly, cookie.Secure, cookie.HttpOnly)
+	}
+	if cookie.SameSite != policy.SameSite {
+		t.Fatalf("expected same site %v but got %v", policy.SameSite, cookie.SameSite)
+	}
+	if maxAge := time.Duration(cookie.MaxAge) * time.Second; maxAge != policy.MaxAge {
+		t.Fatalf("expected max age %s but got %s", policy.MaxAge, maxAge)
+	}
+
+	if prefix := New(GenerateRandomKey(32)).CookiePolicy().Prefix; prefix != "" {
+		t.Fatalf("expected no prefix for the default name but got %s", prefix)
+	}
+}
+
+func TestSessionDefaults(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name     string
+		opts     Options
+		expected CookiePolicy
+	}{
+		{
+			name: "secure",
+			opts: SecureDefaults(),
+			expected: CookiePolicy{
+				Name:     "__Host-session",
+				Prefix:   "__Host-",
+				Path:     "/",
+				Secure:   true,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+				MaxAge:   30 * time.Minute,
+			},
+		},
+		{
+			name: "dev",
+			opts: DevDefaults(),
+			expected: CookiePolicy{
+				Name:     "_session",
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+				MaxAge:   365 * 24 * time.Hour,
+			},
+		},
+	} {
+		if err := tt.opts.Validate(); err != nil {
+			t.Fatalf("%s: expected valid options but got %v", tt.name, err)
+		}
+
+		s := New(GenerateRandomKey(32), tt.opts)
+		if policy := s.CookiePolicy(); policy != tt.expected {
+			t.Fatalf("%s: expected policy %+v but got %+v", tt.name, tt.expected, policy)
+		}
+
+		rr := httptest.NewRecorder()
+		s.Set(rr, httptest.NewRequest(http.MethodGet, "/", nil), "key", "value")
+		cookie := rr.Result().Cookies()[0]
+		if cookie.Name != tt.expected.Name || cookie.Secure != tt.expected.Secure || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+			t.Fatalf("%s: expected cookie to match policy %+v but got %+v", tt.name, tt.expected, cookie)
+		}
+		if maxAge := time.Duration(cookie.MaxAge) * time.Second; maxAge != tt.expected.MaxAge {
+			t.Fatalf("%s: expected max age %s but got %s", tt.name, tt.expected.MaxAge, maxAge)
+		}
+	}
+
+	// The presets can be overridden.
+	opts := SecureDefaults()
+	opts.Insecure = true
+	if err := opts.Validate(); err == nil {
+		t.Fatal("expected an insecure cookie with the __Host- prefix to be invalid")
+	}
+}
+
+func TestSessionRefreshAfter(t *testing.T) {
+	t.Parallel()
+
+	opts := SecureDefaults()
+	opts.Insecure = true
+	s := New(GenerateRandomKey(32), opts)
+
+	// cookie returns a session cookie for a session last saved at the given
+	// time.
+	cookie := func(updated time.Time) *http.Cookie {
+		value, err := s.encode(s.name, &session{
+			Data:      map[string]interface{}{"key": "value"},
+			UpdatedAt: updated,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &http.Cookie{Name: s.name, Value: value}
+	}
+
+	read := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := s.Get(r, "key"); v != "value" {
+			t.Errorf("expected value but got %v", v)
+		}
+		w.Write([]byte("hello"))
+	})
+
+	for _, tt := range []struct {
+		name    string
+		updated time.Time
+		refresh bool
+	}{
+		{"recent", time.Now().Add(-time.Minute), false},
+		{"stale", time.Now().Add(-20 * time.Minute), true},
+	} {
+		for name, h := range map[string]http.Handler{
+			"Middleware":      s.Middleware(read),
+			"TemplMiddleware": s.TemplMiddleware(read),
+		} {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.AddCookie(cookie(tt.updated))
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			cookies := rr.Result().Cookies()
+			if refreshed := len(cookies) == 1; refreshed != tt.refresh {
+				t.Fatalf("expected %s session to be refreshed by the %s to be %t but got cookies %v", tt.name, name, tt.refresh, cookies)
+			}
+			if tt.refresh && cookies[0].MaxAge != 30*60 {
+				t.Fatalf("expected refreshed cookie to have a Max-Age of 30 minutes but got %d", cookies[0].MaxAge)
+			}
+		}
+	}
+}
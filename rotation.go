@@ -0,0 +1,54 @@
+package sessions
+
+import (
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// refreshKeys replaces the session's codecs with ones for the keys returned
+// by the KeyProvider option. The current codecs are kept if the provider
+// doesn't return any keys.
+func (s *Session) refreshKeys(o Options) {
+	keys := o.KeyProvider()
+	if len(keys) == 0 {
+		s.logf(LevelWarning, "KeyProvider returned no keys - using the previous keys")
+		return
+	}
+
+	codecs := make([]*securecookie.SecureCookie, 0, len(keys))
+	for _, key := range keys {
+		codecs = append(codecs, newCodec(key, o))
+	}
+
+	s.mu.Lock()
+	s.codecs = codecs
+	s.mu.Unlock()
+}
+
+// pollKeys refreshes the session's keys at the KeyRefreshInterval until Close
+// is called.
+func (s *Session) pollKeys(o Options) {
+	ticker := time.NewTicker(o.KeyRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.refreshKeys(o)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Close stops refreshing the keys from the KeyProvider option. The keys that
+// were last returned by the provider continue to be used. It's safe to call
+// Close more than once, and it does nothing when KeyProvider isn't set.
+func (s *Session) Close() {
+	s.closeOnce.Do(func() {
+		if s.done != nil {
+			close(s.done)
+		}
+	})
+}
@@ -0,0 +1,125 @@
+package sessions
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionKeyProvider(t *testing.T) {
+	t.Parallel()
+
+	oldKey := GenerateRandomKey(32)
+	newKey := GenerateRandomKey(32)
+
+	var mu sync.Mutex
+	keys := [][]byte{oldKey}
+
+	s := New(nil, Options{
+		KeyProvider: func() [][]byte {
+			mu.Lock()
+			defer mu.Unlock()
+			return keys
+		},
+		KeyRefreshInterval: time.Millisecond,
+	})
+	t.Cleanup(s.Close)
+
+	rr := httptest.NewRecorder()
+	s.Set(rr, httptest.NewRequest(http.MethodGet, "/", nil), "key", "value")
+	oldCookie := rr.Result().Cookies()[0]
+
+	// Rotate the keys, keeping the old key so that existing cookies are
+	// still accepted.
+	mu.Lock()
+	keys = [][]byte{newKey, oldKey}
+	mu.Unlock()
+
+	// Wait for the new keys to be picked up by the background refresh, which
+	// is when new cookies are signed with the new key.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rr := httptest.NewRecorder()
+		s.Set(rr, httptest.NewRequest(http.MethodGet, "/", nil), "key", "value")
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(rr.Result().Cookies()[0])
+		if New(newKey).Verify(req) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected cookies to be signed with the new key")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(oldCookie)
+	if v := s.Get(req, "key"); v != "value" {
+		t.Fatalf("expected cookie signed with the old key to decode but got %v", v)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	calls := 0
+
+	s := New(nil, Options{
+		KeyProvider: func() [][]byte {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			return [][]byte{GenerateRandomKey(32)}
+		},
+		KeyRefreshInterval: time.Millisecond,
+	})
+	s.Close()
+	// Calling Close again must not panic.
+	s.Close()
+
+	mu.Lock()
+	before := calls
+	mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	mu.Lock()
+	after := calls
+	mu.Unlock()
+
+	// A refresh that was already running when Close was called may still
+	// finish, but no more are started.
+	if after > before+1 {
+		t.Fatalf("expected keys not to be refreshed after Close but got %d calls", after-before)
+	}
+
+	// Close does nothing without a KeyProvider.
+	New(GenerateRandomKey(32)).Close()
+}
+
+func TestSessionKeyRefreshIntervalNegative(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	s := New(nil, Options{
+		Logger:             log.New(buf, "", 0),
+		KeyProvider:        func() [][]byte { return [][]byte{GenerateRandomKey(32)} },
+		KeyRefreshInterval: -time.Second,
+	})
+	t.Cleanup(s.Close)
+
+	// Give the background goroutine a chance to start, which panics if its
+	// ticker is created with the negative interval.
+	time.Sleep(10 * time.Millisecond)
+
+	if logs := buf.String(); !strings.Contains(logs, "KeyRefreshInterval is -1s, but must not be negative") {
+		t.Fatalf("expected the negative interval to be logged but got %q", logs)
+	}
+}
@@ -40,11 +40,23 @@ package sessions
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"hash"
+	"log"
+	"maps"
+	"net"
 	"net/http"
+	"os"
+	"reflect"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fxamacker/cbor/v2"
@@ -54,245 +66,2602 @@ import (
 // Version is the released version of the library.
 const Version = "1.3.0"
 
-type sessionCtxKeyType struct{}
+// sessionCtxKeyType is the type of the context keys that sessions are stored
+// under. Each session manager stores its sessions under a key for itself,
+// so that multiple session managers can be used with the same request, and
+// under sessionCtxKey for the package-level FlashesCtx.
+type sessionCtxKeyType struct {
+	s *Session
+}
+
+type templCtxKeyType struct{}
+
+// cacheCtxKeyType is the type of the context keys that each session manager's
+// sessionCache is stored under.
+type cacheCtxKeyType struct {
+	s *Session
+}
+
+// A sessionCache holds the session decoded by the first read of a request
+// handled by the Middleware or TemplMiddleware, so that later reads of the
+// same request don't decode it again, and the latest session saved for the
+// request. The cache is installed by the middleware, rather than
+// attaching the session to the request on the first read, since changing the
+// request isn't safe when it's read concurrently.
+type sessionCache struct {
+	mu sync.Mutex
+	ss *session
+}
+
+// load returns the cached session, decoding it from the request first if it
+// hasn't been yet.
+func (c *sessionCache) load(s *Session, r *http.Request) *session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ss == nil {
+		c.ss = s.decode(r)
+	}
+	return c.ss
+}
+
+// store replaces the cached session with the given session once it's saved,
+// so that the TemplMiddleware saves the latest session, even when the session
+// was replaced by another one, for example, by Logout.
+func (c *sessionCache) store(ss *session) {
+	c.mu.Lock()
+	c.ss = ss
+	c.mu.Unlock()
+}
 
 const (
 	defaultSessionName = "_session"
 	defaultMaxAge      = 86400 * 365
+	defaultLogPrefix   = "sessions: "
+	defaultMaxKeyLen   = 256
+	defaultKeyRefresh  = time.Minute
+	defaultMaxBuffer   = 64 << 10
+	defaultErrorLog    = time.Minute
+
+	// reservedPrefix is the prefix of keys used internally by the library,
+	// which cannot be set by callers.
+	reservedPrefix = "_sessions."
+
+	// maxOnceTokens is the number of most recently consumed tokens that are
+	// remembered by ConsumeOnce.
+	maxOnceTokens = 32
+
+	// sessionVersion is the version of the session's layout, which must be
+	// incremented whenever a field is added to the session that must be
+	// filled in when decoding a session encoded by an older version. Sessions
+	// encoded before the version was recorded are version 1.
+	sessionVersion = 2
 )
 
 var (
 	sessionCtxKey = sessionCtxKeyType{}
+
+	// templCtxKey marks requests that are already being handled by the
+	// session's TemplMiddleware.
+	templCtxKey = templCtxKeyType{}
 )
 
-type cborSerializer struct{}
+type cborSerializer struct {
+	// compressThreshold is the size in bytes above which serialized values
+	// are compressed, or zero if they're never compressed.
+	compressThreshold int
+}
 
 func (cs *cborSerializer) Serialize(src interface{}) ([]byte, error) {
-	return cbor.Marshal(src)
+	var b []byte
+	if eb, ok := src.(*encodeBuffer); ok {
+		if err := cbor.MarshalToBuffer(eb.v, &eb.b); err != nil {
+			return nil, err
+		}
+		b = eb.b.Bytes()
+	} else {
+		var err error
+		if b, err = cbor.Marshal(src); err != nil {
+			return nil, err
+		}
+	}
+
+	if cs.compressThreshold > 0 && len(b) > cs.compressThreshold {
+		return compress(b)
+	}
+	return b, nil
 }
+
 func (cs *cborSerializer) Deserialize(src []byte, dst interface{}) error {
+	if isCompressed(src) {
+		b, err := decompress(src)
+		if err != nil {
+			return err
+		}
+		src = b
+	}
 	return cbor.Unmarshal(src, dst)
 }
 
-func init() {
-	// Register the encodings used in this package with gob such that we can
-	// successfully save session data in the session.
-	gob.Register([]interface{}{})
-	gob.Register(map[string]interface{}{})
-	gob.Register(&session{})
+// An encodeBuffer is a value to be serialized into a reusable buffer by the
+// cborSerializer, rather than into a newly allocated slice. The securecookie
+// codec doesn't hold on to the serialized value once encoding is done, so the
+// buffer can be reused as soon as the codec returns.
+type encodeBuffer struct {
+	v interface{}
+	b bytes.Buffer
+}
+
+var encodeBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(encodeBuffer)
+	},
+}
+
+// gobRegistered is whether registerGob has registered the package's types.
+var gobRegistered atomic.Bool
+
+// registerGob registers the encodings used in this package with gob such that
+// session data can be saved by codecs that use gob, which is securecookie's
+// default serializer. Registering types with gob changes process-wide state,
+// so it's done when a session manager that might use gob is first created,
+// rather than when the package is initialized. Session managers created with
+// New use CBOR, so they never register the types.
+var registerGob = sync.OnceFunc(func() {
+	gob.Register([]interface{}{})
+	gob.Register(map[string]interface{}{})
+	gob.Register(&session{})
+	gob.Register(FlashMessage{})
+	gobRegistered.Store(true)
+})
+
+// GenerateRandomKey creates a random key with the given length in bytes. On
+// failure, returns nil.
+//
+// Note that keys created using `GenerateRandomKey()` are not automatically
+// persisted. New keys will be created when the application is restarted, and
+// previously issued cookies will not be able to be decoded.
+//
+// Callers should explicitly check for the possibility of a nil return, treat
+// it as a failure of the system random number generator, and not continue.
+//
+// This function is an alias of securecookie.GenerateRandomKey, and is
+// provided as a convenience method to avoid the additional import of the
+// securecookie library.
+func GenerateRandomKey(length int) []byte {
+	return securecookie.GenerateRandomKey(length)
+}
+
+// A Session manages setting and getting data from the cookie that stores the
+// session data.
+type Session struct {
+	name            string
+	domain          string
+	maxAge          int // The lifetime of the cookie in seconds.
+	refreshAfter    int
+	insecure        bool
+	names           []string // The primary name followed by any fallbacks.
+	quiet           bool
+	logger          *log.Logger
+	logPrefix       string
+	logLevel        LogLevel
+	decodeErrors    *errorLimiter
+	deleteWhenEmpty bool
+	transformer     Transformer
+	maxKeyLength    int
+	maxKeys         int
+	maxValueSize    int
+	maxBufferReuse  int
+
+	separateFlashCookie bool
+	flashName           string
+	cookieWriter        func(w http.ResponseWriter, c *http.Cookie)
+	omitExpires         bool
+	responseHeader      string
+	bindTolerance       int
+	headerOnly          bool
+	contextKey          interface{}
+	compat              *CompatDecoder
+	fallbackCodecs      []securecookie.Codec
+	ephemeral           bool
+	rotateValue         bool
+	skipSave            func(r *http.Request) bool
+	warnStaleGeneration bool
+	flashOrder          FlashOrder
+	afterSave           func(r *http.Request, data map[string]interface{})
+
+	// hashKey is the key used to hash the keys of session data when the
+	// HashKeys option is set, or nil if keys are stored as is.
+	hashKey []byte
+
+	// bindFunc is the BindFunc option, and bindKey is the key used to hash
+	// the fingerprints it returns.
+	bindFunc func(r *http.Request) string
+	bindKey  []byte
+
+	// pooled is whether the codec uses the cborSerializer, which allows
+	// sessions to be serialized into a pooled buffer.
+	pooled bool
+
+	// mu guards codecs, which are replaced when the keys from the
+	// KeyProvider option are refreshed. The first codec is used to encode
+	// cookies, and all of them are tried when decoding.
+	mu     sync.RWMutex
+	codecs []*securecookie.SecureCookie
+
+	// done is closed by Close to stop the goroutine that refreshes the keys
+	// from the KeyProvider option.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// A Transformer transforms individual session values as they are written to
+// and read from the session, for example, to encrypt a single sensitive
+// value while leaving the rest of the session as is.
+type Transformer interface {
+	// OnWrite is called with the key and value passed to Set, and returns the
+	// value to store in the session.
+	OnWrite(key string, v interface{}) (interface{}, error)
+
+	// OnRead is called with the key and stored value in Get, and returns the
+	// value to return to the caller.
+	OnRead(key string, v interface{}) (interface{}, error)
+}
+
+// Options to customize the behaviour of the session.
+type Options struct {
+	// The name of the cookie (default is "_session").
+	Name string
+
+	// Domain is the domain attribute of the cookie (default is none, which
+	// restricts the cookie to the host that set it). A leading dot is
+	// ignored, as it is by browsers. A warning is logged when the session is
+	// saved in response to a request for a host that isn't within the
+	// domain, since browsers reject the cookie.
+	Domain string
+
+	// Insecure defines whether or not to set the cookie without the Secure
+	// attribute, which allows it to be sent over plain HTTP, for example,
+	// for local development with browsers that don't treat localhost as
+	// secure. It must never be set in production. Defaults to false.
+	Insecure bool
+
+	// NamePrefix is prepended to the name of the cookie, as well as to each
+	// of the FallbackNames, for example, to keep the cookies of different
+	// environments that share a domain apart.
+	NamePrefix string
+
+	// FallbackNames are additional cookie names to read the session from when
+	// no valid cookie with the primary name is present, which allows renaming
+	// the session cookie without discarding existing sessions. Sessions are
+	// always saved under the primary name, and a cookie read from a fallback
+	// name is deleted when the session is next saved.
+	FallbackNames []string
+
+	// MaxAge of the cookie before expiry (default is 365 days). Set it to
+	// -1 for no expiry, in which case the cookie is kept by the browser for
+	// the default of 365 days, but is accepted for as long as it's sent.
+	MaxAge int
+
+	// RefreshAfter is the number of seconds since the session was last saved
+	// after which the Middleware and TemplMiddleware save it again, even if
+	// it's unchanged (default is 0, which never refreshes the session). Since
+	// the cookie's MaxAge starts over each time the session is saved, setting
+	// it to less than MaxAge makes MaxAge an idle timeout for sessions that
+	// are only read, rather than a timeout since the session was last
+	// changed. Refreshing the cookie requires one of the middleware, since
+	// there is no response to set the cookie on otherwise.
+	RefreshAfter int
+
+	// DecodeMaxAge is the maximum age in seconds of the cookies that are
+	// accepted, which is checked using the time the cookie was signed, so it
+	// can't be extended by tampering with the cookie's attributes (default is
+	// MaxAge). Set it to -1 to accept cookies of any age. It's ignored by
+	// NewFromCodec.
+	DecodeMaxAge int
+
+	// MaxLength is the maximum length in bytes of the encoded cookie value
+	// (default is 4096). Set it to -1 for no limit. Sessions that encode to
+	// a longer value can't be saved, and cookies with a longer value are
+	// rejected when decoded.
+	//
+	// Most browsers limit the size of each cookie to around 4096 bytes,
+	// including its name and attributes, and silently discard cookies that
+	// are larger, so raising the limit is only useful when the cookie is not
+	// stored by a browser.
+	MaxLength int
+
+	// HashFunc is the hash function used by the HMAC that signs the cookie
+	// (default is SHA-256). Cookies signed with a different hash function
+	// are rejected. It's ignored by NewFromCodec.
+	HashFunc func() hash.Hash
+
+	// Quiet defines whether or not to suppress all error and warning messages
+	// from the library. Defaults to false, since when correctly used, these
+	// messages should never appear. Setting to true may suppress critical
+	// error and warning messages.
+	Quiet bool
+
+	// Logger is the logger that error and warning messages are written to
+	// (default is a logger that writes to standard output).
+	Logger *log.Logger
+
+	// LogPrefix is the prefix of every message logged by the library
+	// (default is "sessions: ").
+	LogPrefix string
+
+	// LogLevel is the minimum level of messages that are logged (default is
+	// LevelWarning). For example, setting it to LevelError suppresses warning
+	// messages while still logging errors.
+	LogLevel LogLevel
+
+	// DeleteWhenEmpty defines whether or not to delete the cookie entirely
+	// when the session holds no data or flashes, rather than sending an
+	// encoded empty session. The cookie is only deleted if the request was
+	// sent with a session cookie, so requests without one get no cookie at
+	// all. Defaults to false.
+	DeleteWhenEmpty bool
+
+	// Transformer, if set, transforms each value written with Set and read
+	// with Get. Other methods, such as List, return the stored values as is.
+	Transformer Transformer
+
+	// MaxKeyLength is the maximum length in bytes of the keys of session data
+	// and flashes (default is 256). Setting a value with a longer key fails.
+	MaxKeyLength int
+
+	// MaxKeys is the maximum number of keys of session data (default is no
+	// limit). Setting a value for a new key once the session has the
+	// maximum number of keys fails, while existing keys can still be
+	// updated. The values of a Namespace count as a single key.
+	MaxKeys int
+
+	// MaxValueSize is the maximum size in bytes of each value of session data
+	// once it's encoded (default is no limit). Setting a larger value with
+	// Set, TrySet, TrySetAll, or AppendToList fails, which catches values
+	// that would make the session cookie too large where they're set.
+	MaxValueSize int
+
+	// MaxBufferReuseSize is the maximum capacity in bytes of a response
+	// buffer that TemplMiddleware reuses for later responses (default is
+	// 64 KiB). Buffers that grew larger while buffering a response are
+	// discarded, so that a few large responses don't keep their memory
+	// around forever. Setting it to -1 reuses buffers of any size.
+	MaxBufferReuseSize int
+
+	// CompressThreshold is the size in bytes of the serialized session above
+	// which the session is compressed before it's signed, which makes larger
+	// sessions fit in a cookie (default is 0, which never compresses the
+	// session). Small sessions are left uncompressed, since compressing them
+	// costs time and can make them larger. Compressed sessions are always
+	// decoded, regardless of the option. It's ignored by NewFromCodec.
+	CompressThreshold int
+
+	// SeparateFlashCookie defines whether or not to store flashes in their
+	// own cookie, named after the session cookie with a "_flash" suffix,
+	// rather than in the session cookie. The flash cookie has no expiry, so
+	// it is deleted when the browser is closed, and setting or reading
+	// flashes only rewrites the flash cookie. Defaults to false.
+	SeparateFlashCookie bool
+
+	// FlashOrder is the order in which DrainFlashes returns flash messages
+	// (default is FlashFIFO). Flash messages from cookies set before the
+	// order of flashes was recorded are treated as the newest, in order of
+	// their keys.
+	FlashOrder FlashOrder
+
+	// CookieWriter sets the given cookie on the response (default is
+	// http.SetCookie). It can be used with frameworks that wrap the response
+	// writer in a way that requires cookies to be set differently.
+	CookieWriter func(w http.ResponseWriter, c *http.Cookie)
+
+	// BindFunc, if set, returns a fingerprint of the client that sent the
+	// given request, such as a hash of its User-Agent and a subnet of its IP
+	// address, which the session is bound to. A session cookie sent by a
+	// client with a different fingerprint is ignored and a warning is logged,
+	// so a stolen cookie can't be used from a very different client. The
+	// fingerprint may be made up of components separated by "|", of which up
+	// to BindTolerance may differ. Sessions saved before the option was set
+	// are bound the next time they're saved. It's ignored by NewFromCodec.
+	BindFunc func(r *http.Request) string
+
+	// BindTolerance is the number of components of the BindFunc fingerprint
+	// that may differ before a session cookie is ignored (default is 0, so
+	// the whole fingerprint must match). The session is bound to the new
+	// fingerprint when it's next saved, so that clients whose network changes
+	// aren't logged out.
+	BindTolerance int
+
+	// OmitExpires leaves the Expires attribute off of the cookies that are
+	// set, keeping only their Max-Age, for proxies that can't parse the date
+	// in the Expires attribute. Browsers that don't support Max-Age keep the
+	// session cookie until they're closed. Defaults to false.
+	OmitExpires bool
+
+	// ResponseHeader is the name of a response header that the encoded
+	// session is also written to each time the session cookie is set, for
+	// example, for an API gateway that manages the session itself (default
+	// is no header). The header's value is the same as the cookie's, so it
+	// can be passed to Import, and it's empty when the session cookie is
+	// deleted. The separate flash cookie isn't written to the header.
+	ResponseHeader string
+
+	// HeaderOnly stops the session cookie from being set when the
+	// ResponseHeader option is set, so that the session is only sent in the
+	// header. Defaults to false.
+	HeaderOnly bool
+
+	// ContextKey, if set, is an additional key that the session is stored
+	// under in the request's context, alongside the library's own key. This
+	// allows the session to be reattached to a context after middleware
+	// replaces the request's context with one that doesn't preserve its
+	// values. The key must be comparable, and should be of an unexported type
+	// to avoid collisions, as with any context key. The key is only checked
+	// by the session's methods, and not by the package-level FlashesCtx.
+	ContextKey interface{}
+
+	// CompatDecoder, if set, is used to decode session cookies that can't be
+	// decoded by the session, such as those set by gorilla/sessions. Legacy
+	// sessions are saved in the native format the next time the session is
+	// saved.
+	CompatDecoder *CompatDecoder
+
+	// FallbackCodecs are additional codecs that are tried in order when a
+	// session cookie can't be decoded by the session's own codec, which
+	// allows changing the codec, for example, to use a different serializer,
+	// without discarding existing sessions. Sessions decoded by a fallback
+	// codec are saved using the session's own codec the next time the
+	// session is saved.
+	FallbackCodecs []securecookie.Codec
+
+	// KeyProvider, if set, returns the current keys to use in place of the
+	// secret passed to New, which allows keys to be rotated without
+	// restarting. The first key is used to sign new cookies, and cookies
+	// signed with any of the keys are accepted. The provider is called when
+	// the session manager is created, and then periodically from a background
+	// goroutine until Close is called. The secret passed to New is used until
+	// the provider returns at least one key. It's ignored by NewFromCodec.
+	KeyProvider func() [][]byte
+
+	// KeyRefreshInterval is how often the KeyProvider is called (default is
+	// one minute).
+	KeyRefreshInterval time.Duration
+
+	// DecodeErrorInterval is how often the same error from decoding a
+	// session cookie is logged (default is one minute), so that a client that
+	// sends an undecodable cookie with every request doesn't flood the logs.
+	// The number of times an error wasn't logged is included the next time
+	// it's logged. Setting it to a negative duration logs every error.
+	DecodeErrorInterval time.Duration
+
+	// Ephemeral defines whether or not the session only lasts for a single
+	// request. An ephemeral session is never read from or written to a
+	// cookie, and is only stored in the request's context, which makes it
+	// useful for request scoped data that's shared between middleware and
+	// handlers. Defaults to false.
+	Ephemeral bool
+
+	// RotateValue defines whether or not to add a random nonce to the session
+	// each time it's saved, so that the encoded cookie value differs on every
+	// response, even when the session data is unchanged. This prevents the
+	// cookie value from being used to track the client. Defaults to false.
+	RotateValue bool
+
+	// HashKeys defines whether or not to store the keys of session data as
+	// short keyed hashes of the keys, rather than as is, so that the names of
+	// the keys aren't revealed to anyone who decodes the cookie's payload.
+	// The keys passed to methods such as Get and Set are hashed
+	// transparently, but methods that return keys, such as List, return
+	// the hashed keys, and WithPrefix, DeletePrefix, and DeleteFunc, which
+	// match keys as they're stored, log an error and do nothing, since the
+	// hashes can't be mapped back to the keys. The keys of flashes and of
+	// the values in a Namespace aren't hashed. Changing the option, or the
+	// secret passed to New, makes the values of existing sessions
+	// inaccessible. It's ignored by NewFromCodec. Defaults to false.
+	HashKeys bool
+
+	// SkipGobRegistration defines whether or not to skip registering the
+	// types used by the session with gob, which is only needed when a codec
+	// passed to NewFromCodec or the FallbackCodecs option uses gob. Session
+	// managers created with New don't use gob, and only register the types
+	// when the FallbackCodecs option is set. Defaults to false.
+	SkipGobRegistration bool
+
+	// WarnStaleGeneration defines whether or not to log a warning when Import
+	// replaces the session from the request's context with a session whose
+	// generation is lower, which means the imported session is older than
+	// the session it replaces. Defaults to false.
+	WarnStaleGeneration bool
+
+	// SkipSave, if set, is called before the session cookie is set on the
+	// response, and the cookie is not set if it returns true, for example, to
+	// avoid creating sessions for requests from crawlers. The session can
+	// still be read and modified for the rest of the request.
+	SkipSave func(r *http.Request) bool
+
+	// AfterSave, if set, is called with the request and the session's data
+	// each time the session is successfully saved, for example, to publish
+	// an event when the session changes. It isn't called when the session
+	// fails to encode. Under the session's Middleware and TemplMiddleware,
+	// it's called once when the cookie is set, rather than each time the
+	// session is modified. The data must not be modified.
+	AfterSave func(r *http.Request, data map[string]interface{})
+}
+
+// New creates a new session manager with the given key.
+func New(secret []byte, opts ...Options) *Session {
+	s, _ := newWithSecret(secret, options(opts), false)
+	return s
+}
+
+// newWithSecret creates a new session manager with the given key and
+// options, checking that it can encode sessions once it's created. If strict
+// is true, an error is returned when the session manager can't encode
+// sessions, rather than logged.
+func newWithSecret(secret []byte, o Options, strict bool) (*Session, error) {
+	switch o.MaxAge {
+	case 0:
+		// Default to one year, since some browsers don't set their cookies
+		// with the same defaults.
+		o.MaxAge = defaultMaxAge
+	case -1:
+		o.MaxAge = 0
+	}
+
+	// Cookies are only accepted for as long as they're kept by the browser,
+	// unless the DecodeMaxAge option says otherwise.
+	switch o.DecodeMaxAge {
+	case 0:
+		o.DecodeMaxAge = o.MaxAge
+	case -1:
+		o.DecodeMaxAge = 0
+	}
+
+	if len(o.FallbackCodecs) > 0 && !o.SkipGobRegistration {
+		registerGob()
+	}
+
+	s := newSession(newCodec(secret, o), o)
+	s.pooled = true
+	if o.MaxAge > 0 {
+		s.maxAge = o.MaxAge
+	}
+	if o.HashKeys {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte("sessions: hash keys"))
+		s.hashKey = mac.Sum(nil)
+	}
+	if o.BindFunc != nil {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte("sessions: bind"))
+		s.bindFunc = o.BindFunc
+		s.bindKey = mac.Sum(nil)
+	}
+	if o.KeyProvider != nil {
+		s.refreshKeys(o)
+	}
+
+	if err := s.checkCodec(); err != nil {
+		if strict {
+			return nil, err
+		}
+		s.logError(err)
+	}
+
+	if o.KeyProvider != nil {
+		// A negative interval is logged as a problem with the options, and
+		// the default is used instead, since the ticker can't be created
+		// with it.
+		if o.KeyRefreshInterval < 0 {
+			o.KeyRefreshInterval = defaultKeyRefresh
+		}
+		s.done = make(chan struct{})
+		go s.pollKeys(o)
+	}
+	return s, nil
+}
+
+// newCodec creates the codec that New uses for the given key and options.
+func newCodec(key []byte, o Options) *securecookie.SecureCookie {
+	sc := securecookie.New(key, nil)
+	sc.MaxAge(o.DecodeMaxAge)
+	switch o.MaxLength {
+	case 0:
+		// Use securecookie's default.
+	case -1:
+		sc.MaxLength(0)
+	default:
+		sc.MaxLength(o.MaxLength)
+	}
+	if o.HashFunc != nil {
+		sc.HashFunc(o.HashFunc)
+	}
+	sc.SetSerializer(&cborSerializer{compressThreshold: o.CompressThreshold})
+	return sc
+}
+
+// NewFromCodec creates a new session manager that encodes and decodes its
+// cookies using the given securecookie instance, which allows for complete
+// control over its configuration, such as its keys, serializer, and maximum
+// length.
+//
+// The MaxAge, DecodeMaxAge, MaxLength, HashFunc, KeyProvider, HashKeys,
+// BindFunc, and CompressThreshold options are ignored, since the codec's own
+// configuration is used to validate cookies, and there is no secret to hash
+// keys and fingerprints with. Note that if the codec uses a serializer other
+// than the default gob serializer, it must be able to encode the types of the
+// values stored in the session.
+//
+// Unless the SkipGobRegistration option is set, the types used by the
+// session are registered with gob, in case the codec uses gob.
+func NewFromCodec(sc *securecookie.SecureCookie, opts ...Options) *Session {
+	o := options(opts)
+	if !o.SkipGobRegistration {
+		registerGob()
+	}
+
+	s := newSession(sc, o)
+	if err := s.checkCodec(); err != nil {
+		s.logError(err)
+	}
+	return s
+}
+
+// options returns the last of the given options, with defaults applied.
+func options(opts []Options) Options {
+	var o Options
+	for _, opt := range opts {
+		o = opt
+	}
+
+	if o.Name == "" {
+		o.Name = defaultSessionName
+	}
+
+	if o.NamePrefix != "" {
+		o.Name = o.NamePrefix + o.Name
+		fallbacks := make([]string, len(o.FallbackNames))
+		for i, name := range o.FallbackNames {
+			fallbacks[i] = o.NamePrefix + name
+		}
+		o.FallbackNames = fallbacks
+		o.NamePrefix = ""
+	}
+
+	if o.Logger == nil {
+		o.Logger = log.New(os.Stdout, "", 0)
+	}
+
+	if o.LogPrefix == "" {
+		o.LogPrefix = defaultLogPrefix
+	}
+
+	if o.MaxKeyLength == 0 {
+		o.MaxKeyLength = defaultMaxKeyLen
+	}
+
+	if o.CookieWriter == nil {
+		o.CookieWriter = http.SetCookie
+	}
+
+	if o.KeyRefreshInterval == 0 {
+		o.KeyRefreshInterval = defaultKeyRefresh
+	}
+
+	if o.MaxBufferReuseSize == 0 {
+		o.MaxBufferReuseSize = defaultMaxBuffer
+	}
+
+	if o.DecodeErrorInterval == 0 {
+		o.DecodeErrorInterval = defaultErrorLog
+	}
+	return o
+}
+
+// newSession creates a new session manager using the given codec and options.
+func newSession(sc *securecookie.SecureCookie, o Options) *Session {
+	s := &Session{
+		codecs:          []*securecookie.SecureCookie{sc},
+		name:            o.Name,
+		domain:          strings.ToLower(strings.TrimPrefix(o.Domain, ".")),
+		maxAge:          defaultMaxAge,
+		refreshAfter:    o.RefreshAfter,
+		insecure:        o.Insecure,
+		names:           append([]string{o.Name}, o.FallbackNames...),
+		quiet:           o.Quiet,
+		logger:          o.Logger,
+		logPrefix:       o.LogPrefix,
+		logLevel:        o.LogLevel,
+		decodeErrors:    &errorLimiter{interval: o.DecodeErrorInterval, seen: make(map[string]*limitedError)},
+		deleteWhenEmpty: o.DeleteWhenEmpty,
+		transformer:     o.Transformer,
+		maxKeyLength:    o.MaxKeyLength,
+		maxKeys:         o.MaxKeys,
+		maxValueSize:    o.MaxValueSize,
+		maxBufferReuse:  o.MaxBufferReuseSize,
+
+		separateFlashCookie: o.SeparateFlashCookie,
+		flashName:           o.Name + "_flash",
+		cookieWriter:        o.CookieWriter,
+		omitExpires:         o.OmitExpires,
+		responseHeader:      o.ResponseHeader,
+		bindTolerance:       o.BindTolerance,
+		headerOnly:          o.HeaderOnly && o.ResponseHeader != "",
+		contextKey:          o.ContextKey,
+		compat:              o.CompatDecoder,
+		fallbackCodecs:      o.FallbackCodecs,
+		ephemeral:           o.Ephemeral,
+		rotateValue:         o.RotateValue,
+		skipSave:            o.SkipSave,
+		warnStaleGeneration: o.WarnStaleGeneration,
+		flashOrder:          o.FlashOrder,
+		afterSave:           o.AfterSave,
+	}
+
+	for _, problem := range o.problems() {
+		s.logf(LevelError, "%s", problem)
+	}
+	return s
+}
+
+// NewWithError is like New, but returns an error wrapping ErrInvalidOptions
+// if the options are invalid, or an error if the session manager can't
+// encode sessions, for example, because the secret is empty, rather than
+// logging the problems and creating the session manager regardless.
+func NewWithError(secret []byte, opts ...Options) (*Session, error) {
+	o := options(opts)
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	return newWithSecret(secret, o, true)
+}
+
+// Validate returns an error wrapping ErrInvalidOptions that describes every
+// problem with the options, such as an invalid cookie name or a negative
+// MaxAge, or nil if the options are valid. The problems are logged as errors
+// when creating a session manager with New or NewFromCodec.
+func (o Options) Validate() error {
+	problems := o.problems()
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrInvalidOptions, strings.Join(problems, "; "))
+}
+
+// problems returns a description of each problem with the options.
+func (o Options) problems() []string {
+	var problems []string
+
+	name := o.Name
+	if name == "" {
+		name = defaultSessionName
+	}
+	names := []string{o.NamePrefix + name}
+	for _, name := range o.FallbackNames {
+		names = append(names, o.NamePrefix+name)
+	}
+
+	for i, name := range names {
+		if !validCookieName(name) {
+			problems = append(problems, fmt.Sprintf("invalid cookie name %q - cookie names may only contain letters, digits, and the characters !#$%%&'*+-.^_`|~", name))
+		}
+		if slices.Contains(names[:i], name) {
+			problems = append(problems, fmt.Sprintf("the cookie name %q is used more than once", name))
+		}
+	}
+	if o.SeparateFlashCookie && slices.Contains(names, names[0]+"_flash") {
+		problems = append(problems, fmt.Sprintf("the flash cookie name %q is also one of the FallbackNames", names[0]+"_flash"))
+	}
+
+	// Browsers reject cookies with the __Host- prefix unless they're set
+	// without a domain.
+	if o.Domain != "" && strings.HasPrefix(strings.ToLower(names[0]), "__host-") {
+		problems = append(problems, fmt.Sprintf("the cookie name %q begins with the __Host- prefix, so the Domain option can't be set", names[0]))
+	}
+
+	// Browsers reject cookies with either the __Host- or __Secure- prefix
+	// unless they're set with the Secure attribute.
+	if o.Insecure {
+		lower := strings.ToLower(names[0])
+		if strings.HasPrefix(lower, "__host-") || strings.HasPrefix(lower, "__secure-") {
+			problems = append(problems, fmt.Sprintf("the cookie name %q begins with a prefix that requires the Secure attribute, so the Insecure option can't be set", names[0]))
+		}
+	}
+
+	if o.MaxAge < -1 {
+		problems = append(problems, fmt.Sprintf("MaxAge is %d, but must be -1 or greater", o.MaxAge))
+	}
+	if o.DecodeMaxAge < -1 {
+		problems = append(problems, fmt.Sprintf("DecodeMaxAge is %d, but must be -1 or greater", o.DecodeMaxAge))
+	}
+	if o.MaxLength < -1 {
+		problems = append(problems, fmt.Sprintf("MaxLength is %d, but must be -1 or greater", o.MaxLength))
+	}
+	if o.RefreshAfter < 0 {
+		problems = append(problems, fmt.Sprintf("RefreshAfter is %d, but must not be negative", o.RefreshAfter))
+	}
+	if o.BindTolerance < 0 {
+		problems = append(problems, fmt.Sprintf("BindTolerance is %d, but must not be negative", o.BindTolerance))
+	}
+	if o.HeaderOnly && o.ResponseHeader == "" {
+		problems = append(problems, "HeaderOnly is set, but ResponseHeader isn't, so the session would never be sent")
+	}
+	if o.MaxBufferReuseSize < -1 {
+		problems = append(problems, fmt.Sprintf("MaxBufferReuseSize is %d, but must be -1 or greater", o.MaxBufferReuseSize))
+	}
+	if o.MaxKeyLength < 0 {
+		problems = append(problems, fmt.Sprintf("MaxKeyLength is %d, but must not be negative", o.MaxKeyLength))
+	}
+	if o.CompressThreshold < 0 {
+		problems = append(problems, fmt.Sprintf("CompressThreshold is %d, but must not be negative", o.CompressThreshold))
+	}
+	if o.MaxValueSize < 0 {
+		problems = append(problems, fmt.Sprintf("MaxValueSize is %d, but must not be negative", o.MaxValueSize))
+	}
+	if o.MaxKeys < 0 {
+		problems = append(problems, fmt.Sprintf("MaxKeys is %d, but must not be negative", o.MaxKeys))
+	}
+	if o.KeyRefreshInterval < 0 {
+		problems = append(problems, fmt.Sprintf("KeyRefreshInterval is %s, but must not be negative", o.KeyRefreshInterval))
+	}
+	return problems
+}
+
+// validCookieName reports whether the given name is a valid cookie name,
+// which is a token as defined by RFC 7230.
+func validCookieName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// A session holds the session data. It contains thirteen fields:
+//
+//   - "data" for long-lived session data that persists between requests,
+//   - "flashes" for session data that should be deleted as soon as it is shown,
+//   - "redirect flashes" for the keys of flashes that are only deleted once
+//     shown in response to a GET request,
+//   - "flash keys" for the keys of flashes in the order they were set,
+//   - "tokens" for the most recently consumed tokens from ConsumeOnce,
+//   - "expires" for the exact time the session expires, if set by SetExpiry,
+//   - "version" for the version of the layout the session was encoded with,
+//   - "created at" and "updated at" for when the session was first and last
+//     saved,
+//   - "gen" for the generation of the session, which is incremented each
+//     time it's saved,
+//   - "id seed" for the random value that the session's ID is derived from,
+//   - "nonce" for the random value that changes the encoded cookie on every
+//     save, if the RotateValue option is set,
+//   - "binding" for the hashes of the client fingerprint from the BindFunc
+//     option, if set.
+type session struct {
+	Data            map[string]interface{}
+	Flashes         map[string]interface{}
+	RedirectFlashes []string
+	FlashKeys       []string `cbor:",omitempty"`
+	Tokens          []string
+	Expires         time.Time
+	Version         int
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	Gen             int
+	IDSeed          []byte   `cbor:",omitempty"`
+	Nonce           []byte   `cbor:",omitempty"`
+	Binding         []string `cbor:",omitempty"`
+
+	// from is the name of the cookie the session was decoded from when it
+	// differs from the primary cookie name.
+	from string
+
+	// err is the error from decoding the session from the request's cookie,
+	// if any.
+	err error
+
+	// size is the length of the cookie value the session was decoded from.
+	size int
+
+	// cookie is the cookie the session was decoded from, if any.
+	cookie *http.Cookie
+
+	// method is the method of the request the session was decoded from.
+	method string
+
+	// flashCookie is whether the request has a separate flash cookie.
+	flashCookie bool
+
+	// cookieSet is whether the session cookie has been set on the response,
+	// in which case it's deleted if the session is emptied later on.
+	cookieSet bool
+
+	// changed is whether the session has been modified since it was
+	// decoded.
+	changed bool
+
+	// committed is whether the session cookie was set by Commit, after which
+	// the session is no longer saved.
+	committed bool
+
+	// frozen is whether the session was frozen by Freeze, after which changes
+	// are made to a copy of the session and discarded.
+	frozen bool
+}
+
+// init ensures that both of the underlying maps have been initialized. It
+// must be called before writing to either map, since sessions decoded from
+// requests without a cookie are left uninitialized to avoid allocating maps
+// on requests that only read from the session.
+func (s *session) init() {
+	if s.Data == nil {
+		s.Data = make(map[string]interface{})
+	}
+	if s.Flashes == nil {
+		s.Flashes = make(map[string]interface{})
+	}
+}
+
+// clone returns a copy of the session that can be modified without changing
+// the original, including the values of namespaces and lists.
+func (s *session) clone() *session {
+	ss := *s
+	ss.Data = maps.Clone(s.Data)
+	for k, v := range ss.Data {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			ss.Data[k] = maps.Clone(v)
+		case []interface{}:
+			ss.Data[k] = slices.Clone(v)
+		}
+	}
+	ss.Flashes = maps.Clone(s.Flashes)
+	ss.RedirectFlashes = slices.Clone(s.RedirectFlashes)
+	ss.FlashKeys = slices.Clone(s.FlashKeys)
+	ss.Tokens = slices.Clone(s.Tokens)
+	return &ss
+}
+
+// consumeFlashes returns a copy of the session's flashes and clears them.
+// When the given request method is not GET, flashes set with
+// FlashForRedirect are returned but not cleared.
+func (s *session) consumeFlashes(method string) map[string]interface{} {
+	values := make(map[string]interface{})
+	for k, v := range s.Flashes {
+		values[k] = v
+	}
+
+	if method != http.MethodGet && method != "" {
+		for k := range s.Flashes {
+			if !slices.Contains(s.RedirectFlashes, k) {
+				delete(s.Flashes, k)
+				s.changed = true
+			}
+		}
+		return values
+	}
+
+	if len(s.Flashes) > 0 {
+		s.changed = true
+	}
+	clear(s.Flashes)
+	s.RedirectFlashes = nil
+	s.FlashKeys = nil
+	return values
+}
+
+// touch records the current time as when the session was last saved, and
+// when it was created if this is its first save, and increments the
+// session's generation.
+func (s *session) touch() {
+	now := time.Now().UTC()
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = now
+	}
+	s.UpdatedAt = now
+	s.Gen++
+	if len(s.IDSeed) == 0 {
+		s.IDSeed = GenerateRandomKey(16)
+	}
+}
+
+// needsRefresh reports whether the given session, which was decoded from the
+// request's cookie, was saved long enough ago that it should be saved again
+// according to the RefreshAfter option.
+func (s *Session) needsRefresh(ss *session) bool {
+	if s.refreshAfter <= 0 || ss.cookie == nil || ss.committed {
+		return false
+	}
+	return time.Since(ss.UpdatedAt) >= time.Duration(s.refreshAfter)*time.Second
+}
+
+// setFlash sets the flash with the given key, moving the key to the end of
+// the order the flashes were set in. The session must be initialized.
+func (s *session) setFlash(key string, value interface{}) {
+	s.Flashes[key] = value
+	s.FlashKeys = slices.DeleteFunc(s.FlashKeys, func(k string) bool {
+		_, ok := s.Flashes[k]
+		return !ok || k == key
+	})
+	s.FlashKeys = append(s.FlashKeys, key)
+}
+
+// flashOrder returns the keys of the session's flashes in the order they were
+// set. Flashes that weren't set in a known order, such as those from cookies
+// set before the order was recorded, come last, sorted by key.
+func (s *session) flashOrder() []string {
+	keys := make([]string, 0, len(s.Flashes))
+	for _, k := range s.FlashKeys {
+		if _, ok := s.Flashes[k]; ok && !slices.Contains(keys, k) {
+			keys = append(keys, k)
+		}
+	}
+
+	n := len(keys)
+	for k := range s.Flashes {
+		if !slices.Contains(keys[:n], k) {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys[n:])
+	return keys
+}
+
+// upgrade upgrades a session decoded from a cookie that was encoded with an
+// older version of the session's layout to the current version, filling in
+// any fields that were added since.
+//
+// Fields that are removed from the session are ignored when decoding, so
+// sessions encoded by a newer version are left as is.
+func (s *session) upgrade() {
+	// Version 2 only adds the version itself, so there's nothing to fill in
+	// for sessions encoded before the version was recorded.
+	if s.Version < sessionVersion {
+		s.Version = sessionVersion
+	}
+}
+
+// empty reports whether the session holds no data, flashes, or tokens.
+func (s *session) empty() bool {
+	return len(s.Data) == 0 && len(s.Flashes) == 0 && len(s.Tokens) == 0
+}
+
+// fromReq returns the session from the request. The returned session's maps
+// may be nil when the request has no session, so callers must call init
+// before writing to them.
+func (s *Session) fromReq(r *http.Request) *session {
+	// Fastpath: if the context has already been decoded, access the
+	// underlying map and return the value associated with the given key.
+	if ss, ok := s.sessionCtx(r.Context()); ok {
+		if ss.frozen {
+			return ss.clone()
+		}
+		return ss
+	}
+
+	// Under the Middleware, the session decoded by the first read is reused
+	// by later reads of the same request. The session isn't marked as
+	// changed, so reading from it alone doesn't cause it to be saved.
+	if c, ok := r.Context().Value(cacheCtxKeyType{s: s}).(*sessionCache); ok {
+		ss := c.load(s, r)
+		if ss.frozen {
+			return ss.clone()
+		}
+		return ss
+	}
+	return s.decode(r)
+}
+
+// sessionCtx returns the session from the given context, checking the
+// library's own key followed by the ContextKey option, if set.
+func (s *Session) sessionCtx(ctx context.Context) (*session, bool) {
+	if ss, ok := ctx.Value(sessionCtxKeyType{s: s}).(*session); ok {
+		return ss, true
+	}
+	if s.contextKey != nil {
+		if ss, ok := ctx.Value(s.contextKey).(*session); ok {
+			return ss, true
+		}
+	}
+	return nil, false
+}
+
+// withSession returns a copy of ctx with the given session stored under the
+// library's own key and the ContextKey option, if set.
+func (s *Session) withSession(ctx context.Context, ss *session) context.Context {
+	ctx = context.WithValue(ctx, sessionCtxKey, ss)
+	ctx = context.WithValue(ctx, sessionCtxKeyType{s: s}, ss)
+	if s.contextKey != nil {
+		ctx = context.WithValue(ctx, s.contextKey, ss)
+	}
+	return ctx
+}
+
+// decode decodes the session from the request's cookie, trying the primary
+// cookie name first followed by each of the fallback names. If none of the
+// cookies are present or valid, an empty uninitialized session is returned
+// that holds the first decoding error that occurred, if any.
+//
+// When the SeparateFlashCookie option is set, the flashes are decoded from
+// the flash cookie into the session as well.
+func (s *Session) decode(r *http.Request) *session {
+	if s.ephemeral {
+		return &session{method: r.Method}
+	}
+
+	ss := s.decodeData(r)
+	if s.bindFunc != nil {
+		ss = s.checkBinding(r, ss)
+	}
+	if s.separateFlashCookie {
+		s.decodeFlashes(r, ss)
+	}
+	return ss
+}
+
+// decodeFlashes decodes the flashes from the request's flash cookie into the
+// given session, if the cookie is present and valid.
+func (s *Session) decodeFlashes(r *http.Request, ss *session) {
+	cookie, err := r.Cookie(s.flashName)
+	if err != nil {
+		return
+	}
+	ss.flashCookie = true
+
+	flashes := &session{}
+	if err := s.decodeCookie(s.flashName, cookie.Value, flashes); err != nil {
+		s.logLimitedf(LevelError, "failed to decode flashes from cookie: %+v", classifyError(err))
+		return
+	}
+
+	ss.init()
+	for k, v := range flashes.Flashes {
+		ss.Flashes[k] = v
+	}
+	for _, k := range flashes.RedirectFlashes {
+		if !slices.Contains(ss.RedirectFlashes, k) {
+			ss.RedirectFlashes = append(ss.RedirectFlashes, k)
+		}
+	}
+	ss.FlashKeys = append(ss.FlashKeys, flashes.FlashKeys...)
+}
+
+// decodeValue decodes a session from the given encoded value, returning an
+// error wrapping one of ErrTampered, ErrExpired, or ErrMalformed if the value
+// is invalid.
+func (s *Session) decodeValue(name, value string) (*session, error) {
+	ss := &session{}
+	if err := s.decodeCookie(name, value, ss); err != nil {
+		return nil, classifyError(err)
+	}
+	ss.upgrade()
+	if !ss.Expires.IsZero() && !time.Now().Before(ss.Expires) {
+		return nil, fmt.Errorf("%w at %s", errSessionExpired, ss.Expires)
+	}
+	return ss, nil
+}
+
+// decodeData decodes the session from the request's session cookie.
+//
+// Browsers may send more than one cookie with the same name, for example,
+// when cookies with the same name were set for different paths, so every
+// cookie with a matching name is tried until one is decoded successfully.
+func (s *Session) decodeData(r *http.Request) *session {
+	var decodeErr error
+	for i, name := range s.names {
+		cookies := cookiesNamed(r, name)
+		if len(cookies) > 1 {
+			s.logf(LevelWarning, "found %d cookies named %s in the request - make sure the session cookie is only set with a single path and domain", len(cookies), name)
+		}
+
+		for _, cookie := range cookies {
+			ss, err := s.decodeValue(name, cookie.Value)
+			if err != nil && !errors.Is(err, errSessionExpired) {
+				if legacy, ok := s.decodeLegacy(name, cookie.Value); ok {
+					s.logf(LevelDebug, "decoded legacy session from cookie %s", name)
+
+					// Mark the session as changed so that it's saved in the
+					// native format.
+					ss, err = legacy, nil
+					ss.changed = true
+				}
+			}
+			if err != nil {
+				if errors.Is(err, errSessionExpired) {
+					s.logf(LevelDebug, "ignored session from cookie: %v", err)
+				} else {
+					s.logLimitedf(LevelError, "failed to decode session from cookie: %+v", err)
+				}
+				if decodeErr == nil {
+					decodeErr = err
+				}
+				continue
+			}
+			if i > 0 {
+				ss.from = name
+			}
+			ss.size = len(cookie.Value)
+			ss.cookie = cookie
+			ss.method = r.Method
+			return ss
+		}
+	}
+
+	return &session{err: decodeErr, method: r.Method}
+}
+
+// ManagedCookieNames returns the names of the cookies in the given request
+// that belong to the session, which are the session cookie, any of the
+// FallbackNames, and the flash cookie, in that order. Each name is only
+// returned once, even if the request has multiple cookies with the name.
+func (s *Session) ManagedCookieNames(r *http.Request) []string {
+	var names []string
+	for _, name := range s.names {
+		if len(cookiesNamed(r, name)) > 0 && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	if len(cookiesNamed(r, s.flashName)) > 0 && !slices.Contains(names, s.flashName) {
+		names = append(names, s.flashName)
+	}
+	return names
+}
+
+// cookiesNamed returns all of the request's cookies with the given name.
+func cookiesNamed(r *http.Request, name string) []*http.Cookie {
+	var cookies []*http.Cookie
+	for _, cookie := range r.Cookies() {
+		if cookie.Name == name {
+			cookies = append(cookies, cookie)
+		}
+	}
+	return cookies
+}
+
+// saveCtx saves a map of session data in the current request's context. It
+// also updates the Set-Cookie header of the response.
+func (s *Session) saveCtx(w http.ResponseWriter, r *http.Request, session *session) {
+	s.save(w, r, session, false)
+}
+
+// saveFlashCtx is like saveCtx, but for when only the session's flashes have
+// changed. When the SeparateFlashCookie option is set, only the flash cookie
+// is updated.
+func (s *Session) saveFlashCtx(w http.ResponseWriter, r *http.Request, session *session) {
+	s.save(w, r, session, true)
+}
+
+// checkDomain logs a warning if the Domain option is set and the host of the
+// given request isn't within the domain, in which case browsers reject the
+// session cookie.
+func (s *Session) checkDomain(r *http.Request) {
+	if s.domain == "" {
+		return
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	if host != s.domain && !strings.HasSuffix(host, "."+s.domain) {
+		s.logf(LevelWarning, "the cookie domain %s does not match the request host %s, so the session cookie will be rejected by the browser", s.domain, host)
+	}
+}
+
+// cookieSetter returns the function that sets the session's cookies on the
+// response, which only sets the flash cookie if flashOnly is true and the
+// SeparateFlashCookie option is set.
+func (s *Session) cookieSetter(flashOnly bool) func(http.ResponseWriter, *session) error {
+	if flashOnly && s.separateFlashCookie {
+		return s.setFlashCookie
+	}
+	return s.setCookie
+}
+
+// save saves the session in the current request's context, and sets its
+// cookies on the response. If only the session's flashes were changed,
+// flashOnly should be true.
+//
+// Under the session's Middleware, the cookies are set just before the
+// response is written instead, so that they're only set once.
+func (s *Session) save(w http.ResponseWriter, r *http.Request, session *session, flashOnly bool) {
+	if session.frozen {
+		s.logf(LevelWarning, "session was modified after it was frozen, so the change was discarded - make sure to modify the session before calling Freeze")
+		return
+	}
+
+	session.changed = true
+	ctx := s.withSession(r.Context(), session)
+	r2 := r.Clone(ctx)
+	*r = *r2
+	if c, ok := ctx.Value(cacheCtxKeyType{s: s}).(*sessionCache); ok {
+		c.store(session)
+	}
+
+	if s.ephemeral || s.skip(r) {
+		return
+	}
+
+	if session.committed {
+		s.logf(LevelWarning, "session was modified after it was committed, so the change will not be saved - make sure to modify the session before calling Commit")
+		return
+	}
+
+	s.checkDomain(r)
+	s.bind(r, session)
+
+	if wt, ok := w.(*writeTracker); ok {
+		if wt.written {
+			s.logf(LevelWarning, "session was modified after the response was written, so the session cookie could not be set - make sure to modify the session before writing the response")
+			return
+		}
+		if wt.s == s {
+			wt.setPending(r, session, flashOnly)
+			return
+		}
+	}
+
+	if err := s.cookieSetter(flashOnly)(w, session); err != nil {
+		s.logf(LevelError, "failed to encode cookie: %+v", err)
+		return
+	}
+
+	// The TemplMiddleware saves the session again once the handler returns,
+	// so the AfterSave hook is only called then.
+	if r.Context().Value(templCtxKey) != s {
+		s.saved(r, session)
+	}
+}
+
+// skip reports whether the session cookie shouldn't be set in response to
+// the given request, according to the SkipSave option.
+func (s *Session) skip(r *http.Request) bool {
+	return s.skipSave != nil && s.skipSave(r)
+}
+
+// saved calls the AfterSave hook, if any, once the given session has been
+// successfully saved.
+func (s *Session) saved(r *http.Request, session *session) {
+	if s.afterSave != nil {
+		s.afterSave(r, session.Data)
+	}
+}
+
+// setCookie encodes the session and sets it as a cookie on the response. If
+// the session is empty and the DeleteWhenEmpty option is set, a cookie that
+// deletes the session cookie is set instead.
+//
+// When the SeparateFlashCookie option is set, the flashes are set as their
+// own cookie.
+func (s *Session) setCookie(w http.ResponseWriter, session *session) error {
+	// Delete the cookie the session was read from if it was one of the
+	// fallback names, since the session is always saved under the primary
+	// name.
+	if session.from != "" {
+		s.deleteCookie(w, session.from)
+		session.from = ""
+	}
+
+	session.touch()
+	saved := session
+
+	if s.separateFlashCookie {
+		if err := s.setFlashCookie(w, session); err != nil {
+			return err
+		}
+
+		// Make a copy of the session without its flashes to encode in the
+		// session cookie.
+		data := *session
+		data.Flashes = nil
+		data.RedirectFlashes = nil
+		data.FlashKeys = nil
+		session = &data
+	}
+
+	if s.deleteWhenEmpty && session.empty() {
+		if s.responseHeader != "" {
+			w.Header().Set(s.responseHeader, "")
+		}
+		// There's nothing to delete if neither the request nor an earlier
+		// save of the response has a session cookie under the primary name.
+		if !s.headerOnly && (session.cookieSet || session.cookie != nil && session.cookie.Name == s.name || session.err != nil) {
+			s.deleteCookie(w, s.name)
+		}
+		return nil
+	}
+
+	encoded, err := s.encode(s.name, session)
+	if err != nil {
+		return err
+	}
+
+	if s.responseHeader != "" {
+		w.Header().Set(s.responseHeader, encoded)
+		if s.headerOnly {
+			return nil
+		}
+	}
+
+	maxAge := s.maxAge
+	expires := time.Now().UTC().Add(time.Duration(s.maxAge) * time.Second)
+	if !session.Expires.IsZero() {
+		maxAge = int(time.Until(session.Expires).Seconds())
+		expires = session.Expires.UTC()
+
+		// A Max-Age of zero omits the attribute, so use -1 to expire the
+		// cookie immediately.
+		if maxAge <= 0 {
+			maxAge = -1
+		}
+	}
+	if s.omitExpires {
+		expires = time.Time{}
+	}
+
+	s.cookieWriter(w, &http.Cookie{
+		Name:     s.name,
+		MaxAge:   maxAge,
+		Expires:  expires,
+		Value:    encoded,
+		Path:     "/",
+		Domain:   s.domain,
+		HttpOnly: true,
+		Secure:   !s.insecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	saved.cookieSet = true
+	return nil
+}
+
+// encode encodes the given value as the value of the cookie with the given
+// name. When possible, the value is serialized into a pooled buffer, which
+// saves allocating a new buffer for each encoded cookie.
+func (s *Session) encode(name string, v interface{}) (string, error) {
+	if ss, ok := v.(*session); ok {
+		ss.Version = sessionVersion
+		if s.rotateValue {
+			ss.Nonce = GenerateRandomKey(16)
+		}
+	}
+
+	sc := s.codec()
+	if !s.pooled {
+		return sc.Encode(name, v)
+	}
+
+	eb := encodeBufferPool.Get().(*encodeBuffer)
+	eb.v = v
+	eb.b.Reset()
+	encoded, err := sc.Encode(name, eb)
+	eb.v = nil
+	encodeBufferPool.Put(eb)
+	return encoded, err
+}
+
+// codec returns the codec used to encode cookies.
+func (s *Session) codec() *securecookie.SecureCookie {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.codecs[0]
+}
+
+// decodeCookie decodes the given cookie value into dst using the first codec
+// that the value was signed for. If none of them can decode the value, the
+// error from the first codec that could verify its signature is returned,
+// or the error from the first codec otherwise.
+func (s *Session) decodeCookie(name, value string, dst interface{}) error {
+	s.mu.RLock()
+	codecs := s.codecs
+	s.mu.RUnlock()
+
+	var decodeErr error
+	for _, sc := range codecs {
+		err := sc.Decode(name, value, dst)
+		if err == nil {
+			return nil
+		}
+		if decodeErr == nil || (errors.Is(decodeErr, securecookie.ErrMacInvalid) && !errors.Is(err, securecookie.ErrMacInvalid)) {
+			decodeErr = err
+		}
+	}
+	return decodeErr
+}
+
+// setFlashCookie encodes the session's flashes and sets them as the flash
+// cookie on the response. If the session has no flashes, the flash cookie is
+// deleted if the request had one.
+func (s *Session) setFlashCookie(w http.ResponseWriter, ss *session) error {
+	if len(ss.Flashes) == 0 {
+		if ss.flashCookie {
+			s.deleteCookie(w, s.flashName)
+			ss.flashCookie = false
+		}
+		return nil
+	}
+
+	encoded, err := s.encode(s.flashName, &session{
+		Flashes:         ss.Flashes,
+		RedirectFlashes: ss.RedirectFlashes,
+		FlashKeys:       ss.FlashKeys,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.cookieWriter(w, &http.Cookie{
+		Name:     s.flashName,
+		Value:    encoded,
+		Path:     "/",
+		Domain:   s.domain,
+		HttpOnly: true,
+		Secure:   !s.insecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	ss.flashCookie = true
+	return nil
+}
+
+// deleteCookie sets a cookie on the response that deletes the cookie with
+// the given name.
+func (s *Session) deleteCookie(w http.ResponseWriter, name string) {
+	expires := time.Unix(0, 0)
+	if s.omitExpires {
+		expires = time.Time{}
+	}
+
+	s.cookieWriter(w, &http.Cookie{
+		Name:     name,
+		MaxAge:   -1,
+		Expires:  expires,
+		Value:    "",
+		Path:     "/",
+		Domain:   s.domain,
+		HttpOnly: true,
+		Secure:   !s.insecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Verify reports whether the given request has a session cookie that is
+// validly signed and has not expired. It is cheaper than reading the session,
+// since the session data itself is not decoded, which makes it useful when
+// only the validity of the session needs to be checked. When the BindFunc
+// option is set, the session must also be bound to the client that sent the
+// request.
+func (s *Session) Verify(r *http.Request) bool {
+	if s.ephemeral {
+		return false
+	}
+
+	for _, name := range s.names {
+		for _, cookie := range cookiesNamed(r, name) {
+			// Decode just the session's expiry and binding, which skips
+			// allocating the session's data.
+			var ss struct {
+				Expires time.Time
+				Binding []string
+			}
+			if err := s.decodeCookie(name, cookie.Value, &ss); err != nil {
+				continue
+			}
+			if s.bindFunc != nil && len(ss.Binding) > 0 && bindingDiff(ss.Binding, s.fingerprint(r)) > s.bindTolerance {
+				continue
+			}
+			if ss.Expires.IsZero() || time.Now().Before(ss.Expires) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HealthCheck returns an error if the session manager can't encode and
+// decode sessions, for example, because the keys from the KeyProvider option
+// are invalid, which makes it suitable for a readiness probe. It doesn't read
+// or write any cookies, so the request to the probe doesn't need a session.
+//
+// Sessions are stored entirely in cookies, so there is no external store to
+// check.
+func (s *Session) HealthCheck(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.checkCodec()
+}
+
+// checkCodec returns an error if the session's codec can't encode and decode
+// sessions. securecookie only reports problems with its keys, such as an
+// empty hash key or a block key of the wrong length, when it's used, at
+// which point every request fails to save its session.
+func (s *Session) checkCodec() error {
+	if s.ephemeral {
+		return nil
+	}
+
+	encoded, err := s.encode(s.name, &session{})
+	if err != nil {
+		return fmt.Errorf("sessions: failed to encode session, make sure the hash key is set and the block key, if any, is 16, 24, or 32 bytes: %w", err)
+	}
+	if _, err := s.decodeValue(s.name, encoded); err != nil {
+		return fmt.Errorf("sessions: failed to decode session: %w", err)
+	}
+	return nil
+}
+
+// Export returns the session from the given request encoded as a signed
+// token, in the same format as the session cookie. The token can be passed
+// to Import by another service that shares the same secret, over a trusted
+// channel, to hand off the session.
+func (s *Session) Export(r *http.Request) (string, error) {
+	return s.encode(s.name, s.fromReq(r))
+}
+
+// Import validates the given token created by Export and installs it as the
+// session for the given request, setting the session cookie on the
+// response. If the token is invalid, an error wrapping one of ErrTampered,
+// ErrExpired, or ErrMalformed is returned and the session is left as is.
+func (s *Session) Import(w http.ResponseWriter, r *http.Request, token string) error {
+	ss, err := s.decodeValue(s.name, token)
+	if err != nil {
+		return err
+	}
+	ss.method = r.Method
+	s.checkGeneration(r, ss)
+	s.replace(r, ss)
+	s.saveCtx(w, r, ss)
+	return nil
+}
+
+// FromQueryParam installs the session from a token created by Export that is
+// passed in the given query parameter of the request's URL, setting the
+// session cookie on the response, like Import. This can be used to establish
+// a session from a link, such as a magic link sent by email to log in. If the
+// query parameter is missing, or the token is invalid, an error wrapping one
+// of ErrTampered, ErrExpired, or ErrMalformed is returned and the session is
+// left as is.
+//
+// The token remains valid until it expires, so a token in a link should be
+// exported from a session with a short expiry set by SetExpiry.
+func (s *Session) FromQueryParam(w http.ResponseWriter, r *http.Request, param string) error {
+	token := r.URL.Query().Get(param)
+	if token == "" {
+		return fmt.Errorf("%w: query parameter %q is missing", ErrMalformed, param)
+	}
+	return s.Import(w, r, token)
+}
+
+// checkGeneration logs a warning if the WarnStaleGeneration option is set and
+// the given session, which is about to replace the session from the given
+// request's context, has a lower generation than the session it replaces.
+func (s *Session) checkGeneration(r *http.Request, ss *session) {
+	if !s.warnStaleGeneration {
+		return
+	}
+	if current := s.fromReq(r); ss.Gen < current.Gen {
+		s.logf(LevelWarning, "replaced session of generation %d with a stale session of generation %d", current.Gen, ss.Gen)
+	}
+}
+
+// GetFromToken returns the session value for the given key from a token
+// created by Export, which allows the session to be read without a request,
+// for example, by a background job that was queued with the token. If the
+// token is invalid, an error wrapping one of ErrTampered, ErrExpired, or
+// ErrMalformed is returned. If the key is not present, the value is nil.
+func (s *Session) GetFromToken(token, key string) (interface{}, error) {
+	ss, err := s.decodeValue(s.name, token)
+	if err != nil {
+		return nil, err
+	}
+
+	value := ss.Data[s.dataKey(key)]
+	if s.transformer != nil && value != nil {
+		v, err := s.transformer.OnRead(key, value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to transform value for key %q on read: %w", key, err)
+		}
+		value = v
+	}
+	return value, nil
+}
+
+// Freeze makes the session read-only for the remainder of the given request.
+// Any changes made to the session after it's frozen, for example, by Set,
+// Delete, or Flash, are discarded and logged, while changes made before it
+// was frozen are still saved. This can be used in middleware that runs after
+// a handler to make sure that it can't undo the handler's changes, such as
+// logging the user out.
+func (s *Session) Freeze(r *http.Request) {
+	ss := s.fromReq(r)
+	ss.frozen = true
+	*r = *r.WithContext(s.withSession(r.Context(), ss))
+}
+
+// Commit sets the session cookie on the response immediately, which can be
+// used to make sure that the cookie is sent before a handler starts
+// streaming its response. The session can't be modified once it has been
+// committed, so any further changes are logged and not saved.
+//
+// Under the TemplMiddleware, the response isn't sent until the handler
+// returns, so there's no need to call Commit before streaming a response.
+func (s *Session) Commit(w http.ResponseWriter, r *http.Request) error {
+	session := s.fromReq(r)
+	*r = *r.Clone(s.withSession(r.Context(), session))
+
+	if s.ephemeral || s.skip(r) {
+		return nil
+	}
+	if wt, ok := w.(*writeTracker); ok && wt.written {
+		return ErrResponseWritten
+	}
+
+	s.checkDomain(r)
+	s.bind(r, session)
+	if err := s.setCookie(w, session); err != nil {
+		return err
+	}
+	session.committed = true
+	s.saved(r, session)
+	return nil
+}
+
+// Err returns the error that occurred when decoding the session from the
+// given request's cookie, which wraps one of ErrTampered, ErrExpired,
+// ErrMalformed, or ErrClientMismatch. It returns nil if the request has no
+// session cookie or the cookie was decoded successfully.
+//
+// When a session cookie cannot be decoded, the other methods on Session
+// behave as if the session is empty, so Err can be used to distinguish a
+// new session from an invalid one.
+func (s *Session) Err(r *http.Request) error {
+	return s.fromReq(r).err
+}
+
+// Session creates a new session from the given HTTP request. If the
+// request already has a cookie with an associated session, the session data
+// is created from the cookie. If not, a new session is created.
+func (s *Session) Get(r *http.Request, key string) interface{} {
+	trace(r, "get", key)
+	data := s.fromReq(r)
+	value := data.Data[s.dataKey(key)]
+
+	if s.transformer != nil && value != nil {
+		v, err := s.transformer.OnRead(key, value)
+		if err != nil {
+			s.logf(LevelError, "failed to transform value for key %q on read: %+v", key, err)
+			return nil
+		}
+		value = v
+	}
+	return value
+}
+
+// Has reports whether the session from the given request has a value for the
+// given key.
+func (s *Session) Has(r *http.Request, key string) bool {
+	_, ok := s.fromReq(r).Data[s.dataKey(key)]
+	return ok
+}
+
+// List returns all key value pairs of session data from the given request.
+// With the HashKeys option, the keys are returned as they're stored, which is
+// as their hashes.
+func (s *Session) List(r *http.Request) map[string]interface{} {
+	data := s.fromReq(r)
+	if data.Data == nil {
+		return make(map[string]interface{})
+	}
+	return data.Data
+}
+
+// WithPrefix returns the key value pairs of session data from the given
+// request whose keys begin with the given prefix.
+func (s *Session) WithPrefix(r *http.Request, prefix string) map[string]interface{} {
+	values := make(map[string]interface{})
+	if !s.canMatchKeys("WithPrefix") {
+		return values
+	}
+	for k, v := range s.fromReq(r).Data {
+		if strings.HasPrefix(k, prefix) {
+			values[k] = v
+		}
+	}
+	return values
+}
+
+// canMatchKeys reports whether the given method, which matches the keys of
+// session data as they're stored, can be used. Under the HashKeys option, the
+// stored keys are hashes that nothing would match, so an error is logged
+// rather than silently doing nothing.
+func (s *Session) canMatchKeys(method string) bool {
+	if s.hashKey == nil {
+		return true
+	}
+	s.logf(LevelError, "%s can't be used with the HashKeys option, since the keys of session data are stored as hashes", method)
+	return false
+}
+
+// validateKey returns an error wrapping ErrInvalidKey if the given key can't
+// be used for session data or flashes.
+func (s *Session) validateKey(key string) error {
+	switch {
+	case key == "":
+		return fmt.Errorf("%w: key is empty", ErrInvalidKey)
+	case len(key) > s.maxKeyLength:
+		return fmt.Errorf("%w: key is %d bytes, which is longer than the maximum of %d bytes", ErrInvalidKey, len(key), s.maxKeyLength)
+	case strings.HasPrefix(key, reservedPrefix):
+		return fmt.Errorf("%w: key %q begins with the reserved prefix %q", ErrInvalidKey, key, reservedPrefix)
+	}
+	return nil
+}
+
+// dataKey returns the key that the value for the given key is stored under in
+// the session data, which is the key itself unless the HashKeys option is
+// set.
+func (s *Session) dataKey(key string) string {
+	if s.hashKey == nil {
+		return key
+	}
+	mac := hmac.New(sha256.New, s.hashKey)
+	mac.Write([]byte(key))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:9])
+}
+
+// checkMaxKeys returns an error wrapping ErrTooManyKeys if setting the given
+// key would exceed the maximum number of keys of the session data.
+func (s *Session) checkMaxKeys(data *session, key string) error {
+	if s.maxKeys <= 0 || len(data.Data) < s.maxKeys {
+		return nil
+	}
+	if _, ok := data.Data[key]; ok {
+		return nil
+	}
+	return fmt.Errorf("%w: session already has the maximum of %d keys", ErrTooManyKeys, s.maxKeys)
+}
+
+// checkValueSize returns an error wrapping ErrValueTooLarge if the given
+// value is larger than the MaxValueSize option once it's encoded.
+func (s *Session) checkValueSize(key string, value interface{}) error {
+	if s.maxValueSize <= 0 {
+		return nil
+	}
+	b, err := cbor.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode value for key %q: %w", key, err)
+	}
+	if len(b) > s.maxValueSize {
+		return fmt.Errorf("%w: value for key %q is %d bytes, which is larger than the maximum of %d bytes", ErrValueTooLarge, key, len(b), s.maxValueSize)
+	}
+	return nil
+}
+
+// SessionData holds both the data and flashes of a session.
+type SessionData struct {
+	Data    map[string]interface{}
+	Flashes map[string]interface{}
+}
+
+// All returns copies of all session data and flash messages from the given
+// request, using a single decode of the session. Unlike Flashes, All does
+// not clear the flash messages.
+func (s *Session) All(r *http.Request) SessionData {
+	data := s.fromReq(r)
+	sd := SessionData{
+		Data:    make(map[string]interface{}, len(data.Data)),
+		Flashes: make(map[string]interface{}, len(data.Flashes)),
+	}
+	for k, v := range data.Data {
+		sd.Data[k] = v
+	}
+	for k, v := range data.Flashes {
+		sd.Flashes[k] = v
+	}
+	return sd
+}
+
+// SizeByKey returns the approximate size in bytes that each value of the
+// session data from the given request takes up in the encoded session,
+// which can be used to find the values that dominate the size of the session
+// cookie. Each key and value is encoded independently, so the sizes don't add
+// up exactly to the size of the encoded session, and the cookie value is then
+// base64 encoded, which makes it roughly 75% larger again.
+func (s *Session) SizeByKey(r *http.Request) map[string]int {
+	data := s.fromReq(r)
+	sizes := make(map[string]int, len(data.Data))
+	for k, v := range data.Data {
+		b, err := cbor.Marshal(map[string]interface{}{k: v})
+		if err != nil {
+			s.logf(LevelError, "failed to encode session value for key %s: %v", k, err)
+			continue
+		}
+		sizes[k] = len(b)
+	}
+	return sizes
+}
+
+// Set sets or updates the given value on the session. If the value can't be
+// set, the error is logged and the session is left as is.
+func (s *Session) Set(w http.ResponseWriter, r *http.Request, key string, value interface{}) {
+	if err := s.TrySet(w, r, key, value); err != nil {
+		s.logf(LevelError, "failed to set session value: %v", err)
+	}
+}
+
+// TrySet sets or updates the given value on the session, returning an error
+// if the value can't be set, for example, because the key is invalid.
+func (s *Session) TrySet(w http.ResponseWriter, r *http.Request, key string, value interface{}) error {
+	trace(r, "set", key)
+	if err := s.validateKey(key); err != nil {
+		return err
+	}
+
+	if s.transformer != nil {
+		v, err := s.transformer.OnWrite(key, value)
+		if err != nil {
+			return fmt.Errorf("failed to transform value for key %q on write: %w", key, err)
+		}
+		value = v
+	}
+	if err := s.checkValueSize(key, value); err != nil {
+		return err
+	}
+
+	key = s.dataKey(key)
+	data := s.fromReq(r)
+	if err := s.checkMaxKeys(data, key); err != nil {
+		return err
+	}
+	data.init()
+	data.Data[key] = value
+	s.saveCtx(w, r, data)
+	return nil
+}
+
+// TrySetAll sets or updates all of the given values on the session, but
+// only if the session cookie would still fit within the MaxLength option
+// once they're set. It returns whether the values were set, and the length of
+// the encoded cookie value with the values set, regardless of whether it fit.
+// If any of the keys are invalid, or the session can't be encoded for any
+// other reason, an error is returned and none of the values are set.
+//
+// With NewFromCodec, the length is only measured if the codec returns the
+// length when the value is too long, as securecookie does.
+func (s *Session) TrySetAll(w http.ResponseWriter, r *http.Request, values map[string]interface{}) (ok bool, size int, err error) {
+	data := s.fromReq(r)
+	scratch := *data
+	scratch.Data = make(map[string]interface{}, len(data.Data)+len(values))
+	for k, v := range data.Data {
+		scratch.Data[k] = v
+	}
+
+	for key, value := range values {
+		trace(r, "set", key)
+		if err := s.validateKey(key); err != nil {
+			return false, 0, err
+		}
+		if s.transformer != nil {
+			v, err := s.transformer.OnWrite(key, value)
+			if err != nil {
+				return false, 0, fmt.Errorf("failed to transform value for key %q on write: %w", key, err)
+			}
+			value = v
+		}
+		if err := s.checkValueSize(key, value); err != nil {
+			return false, 0, err
+		}
+
+		key = s.dataKey(key)
+		if err := s.checkMaxKeys(&scratch, key); err != nil {
+			return false, 0, err
+		}
+		scratch.Data[key] = value
+	}
+
+	// Encode the session as setCookie would, without its flashes if they're
+	// stored in their own cookie.
+	scratch.touch()
+	if s.separateFlashCookie {
+		scratch.Flashes = nil
+		scratch.RedirectFlashes = nil
+		scratch.FlashKeys = nil
+	}
+	encoded, err := s.encode(s.name, &scratch)
+	if err != nil {
+		if n, ok := tooLongLength(err); ok {
+			return false, n, nil
+		}
+		return false, 0, err
+	}
+
+	data.Data = scratch.Data
+	s.saveCtx(w, r, data)
+	return true, len(encoded), nil
+}
+
+// CompareAndSwap sets the given key to new, but only if its current value
+// is equal to old, and reports whether the value was set. A key that isn't
+// present has a value of nil, so old must be nil to set a new key. The session
+// is only saved if the value was set. As with ChangesCtx, values are compared
+// by their encoding, since a value decoded from the cookie doesn't always
+// have the same type as the value that was set.
+func (s *Session) CompareAndSwap(w http.ResponseWriter, r *http.Request, key string, old, new interface{}) bool {
+	if !sameValue(s.Get(r, key), old) {
+		return false
+	}
+	if err := s.TrySet(w, r, key, new); err != nil {
+		s.logf(LevelError, "failed to set session value: %v", err)
+		return false
+	}
+	return true
+}
+
+// AppendToList appends the given value to the list of values stored under the
+// given key, keeping only the most recent max values. If max is zero or
+// less, the list is not trimmed. A missing value, or a value that is not a
+// list, is treated as an empty list.
+func (s *Session) AppendToList(w http.ResponseWriter, r *http.Request, key string, value interface{}, max int) {
+	trace(r, "set", key)
+	if err := s.validateKey(key); err != nil {
+		s.logf(LevelError, "failed to set session value: %v", err)
+		return
+	}
+
+	if err := s.checkValueSize(key, value); err != nil {
+		s.logf(LevelError, "failed to set session value: %v", err)
+		return
+	}
+
+	key = s.dataKey(key)
+	data := s.fromReq(r)
+	if err := s.checkMaxKeys(data, key); err != nil {
+		s.logf(LevelError, "failed to set session value: %v", err)
+		return
+	}
+	data.init()
+
+	list, _ := data.Data[key].([]interface{})
+	list = append(list, value)
+	if max > 0 && len(list) > max {
+		list = list[len(list)-max:]
+	}
+	data.Data[key] = list
+
+	s.saveCtx(w, r, data)
+}
+
+// Delete deletes and returns the session value with the given key.
+func (s *Session) Delete(w http.ResponseWriter, r *http.Request, key string) interface{} {
+	trace(r, "delete", key)
+	key = s.dataKey(key)
+	data := s.fromReq(r)
+	value := data.Data[key]
+	delete(data.Data, key)
+	s.saveCtx(w, r, data)
+	return value
+}
+
+// DeletePrefix deletes all session values whose keys begin with the given
+// prefix.
+func (s *Session) DeletePrefix(w http.ResponseWriter, r *http.Request, prefix string) {
+	if !s.canMatchKeys("DeletePrefix") {
+		return
+	}
+	data := s.fromReq(r)
+	for k := range data.Data {
+		if strings.HasPrefix(k, prefix) {
+			delete(data.Data, k)
+		}
+	}
+	s.saveCtx(w, r, data)
+}
+
+// DeleteFunc deletes all session values for which pred returns true, and
+// returns the number of values that were deleted. The session is only saved
+// if any values were deleted. As with List, pred is called with the keys as
+// they're stored in the session.
+func (s *Session) DeleteFunc(w http.ResponseWriter, r *http.Request, pred func(key string, value interface{}) bool) int {
+	if !s.canMatchKeys("DeleteFunc") {
+		return 0
+	}
+	data := s.fromReq(r)
+	n := 0
+	for k, v := range data.Data {
+		if pred(k, v) {
+			delete(data.Data, k)
+			n++
+		}
+	}
+	if n > 0 {
+		s.saveCtx(w, r, data)
+	}
+	return n
+}
+
+// Reset resets the session, deleting all values.
+func (s *Session) Reset(w http.ResponseWriter, r *http.Request) {
+	s.saveCtx(w, r, s.replace(r, &session{
+		Data:    make(map[string]interface{}),
+		Flashes: make(map[string]interface{}),
+	}))
+}
+
+// replace prepares the given session to replace the session from the given
+// request, carrying over the state of the request's cookies, such as the
+// name of the fallback cookie the session was read from, if any, and whether
+// the request has a separate flash cookie, so that those cookies are still
+// deleted when the new session is saved. A session that was frozen or
+// committed stays that way, so that it can't be replaced either.
+func (s *Session) replace(r *http.Request, ss *session) *session {
+	old := s.fromReq(r)
+	ss.from = old.from
+	ss.err = old.err
+	ss.size = old.size
+	ss.cookie = old.cookie
+	ss.flashCookie = old.flashCookie
+	ss.cookieSet = old.cookieSet
+	ss.frozen = old.frozen
+	ss.committed = old.committed
+	return ss
+}
+
+// ResetExcept resets the session, deleting all values except for those with
+// the given keys, for example, to keep a user's preferences when they log
+// out.
+func (s *Session) ResetExcept(w http.ResponseWriter, r *http.Request, keep ...string) {
+	data := s.fromReq(r)
+	ss := s.replace(r, &session{
+		Data:    make(map[string]interface{}, len(keep)),
+		Flashes: make(map[string]interface{}),
+	})
+	for _, k := range keep {
+		k = s.dataKey(k)
+		if v, ok := data.Data[k]; ok {
+			ss.Data[k] = v
+		}
+	}
+	s.saveCtx(w, r, ss)
+}
+
+// SetExpiry sets the session to expire at the given time, rather than after
+// the session's maximum age. The cookie's Expires and Max-Age attributes are
+// set to match, and the expiry is stored in the session itself such that the
+// session is not accepted after the given time, regardless of the cookie's
+// attributes.
+//
+// The expiry cannot extend the session beyond the maximum age of the session
+// manager, since signed cookies older than the maximum age are never
+// accepted.
+func (s *Session) SetExpiry(w http.ResponseWriter, r *http.Request, at time.Time) {
+	data := s.fromReq(r)
+	data.Expires = at
+	s.saveCtx(w, r, data)
+}
+
+// Timestamps returns when the session from the given request was first and
+// last saved, or false if the session has never been saved. The creation
+// time of a session from a cookie set before the timestamps were recorded is
+// when the session was next saved. The timestamps are stored in the cookie
+// with a precision of one second.
+func (s *Session) Timestamps(r *http.Request) (created, updated time.Time, ok bool) {
+	data := s.fromReq(r)
+	if data.CreatedAt.IsZero() {
+		return time.Time{}, time.Time{}, false
+	}
+	return data.CreatedAt, data.UpdatedAt, true
+}
+
+// ID returns an identifier for the session from the given request, which is
+// the same for every request with the same session, for example, to group a
+// user's requests in logs. The ID is derived from a random value stored in
+// the session, and reveals nothing about the session's data. Sessions that
+// have never been saved get a new ID for each request until they're saved,
+// and the ID changes when the session is reset or regenerated.
+func (s *Session) ID(r *http.Request) string {
+	data := s.fromReq(r)
+	if len(data.IDSeed) == 0 {
+		// Keep the seed in the session from the request's context, so that
+		// the ID stays the same if the session is saved later on.
+		data.IDSeed = GenerateRandomKey(16)
+		*r = *r.WithContext(s.withSession(r.Context(), data))
+	}
+
+	sum := sha256.Sum256(data.IDSeed)
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
 }
 
-// GenerateRandomKey creates a random key with the given length in bytes. On
-// failure, returns nil.
-//
-// Note that keys created using `GenerateRandomKey()` are not automatically
-// persisted. New keys will be created when the application is restarted, and
-// previously issued cookies will not be able to be decoded.
-//
-// Callers should explicitly check for the possibility of a nil return, treat
-// it as a failure of the system random number generator, and not continue.
-//
-// This function is an alias of securecookie.GenerateRandomKey, and is
-// provided as a convenience method to avoid the additional import of the
-// securecookie library.
-func GenerateRandomKey(length int) []byte {
-	return securecookie.GenerateRandomKey(length)
+// Regenerate gives the session from the given request a new ID, keeping its
+// data as is, and saves the session. The ID should be regenerated when the
+// privileges of the session change, so that requests from before and after
+// the change can be told apart.
+func (s *Session) Regenerate(w http.ResponseWriter, r *http.Request) {
+	data := s.fromReq(r)
+	data.IDSeed = GenerateRandomKey(16)
+	s.saveCtx(w, r, data)
 }
 
-// A Session manages setting and getting data from the cookie that stores the
-// session data.
-type Session struct {
-	sc    *securecookie.SecureCookie
-	name  string
-	quiet bool
+// Generation returns the generation of the session from the given request,
+// which is incremented each time the session is saved, or zero if the session
+// has never been saved. Comparing generations can be used to detect that a
+// session is older than another copy of the same session.
+func (s *Session) Generation(r *http.Request) int {
+	return s.fromReq(r).Gen
 }
 
-// Options to customize the behaviour of the session.
-type Options struct {
-	// The name of the cookie (default is "_session").
-	Name string
+// ResetFlashes resets the session's flashes, deleting all flash messages
+// without deleting any session data.
+func (s *Session) ResetFlashes(w http.ResponseWriter, r *http.Request) {
+	data := s.fromReq(r)
+	clear(data.Flashes)
+	data.RedirectFlashes = nil
+	data.FlashKeys = nil
+	s.saveFlashCtx(w, r, data)
+}
 
-	// MaxAge of the cookie before expiry (default is 365 days). Set it to
-	// -1 for no expiry.
-	MaxAge int
+// Flash sets a flash message on a request.
+func (s *Session) Flash(w http.ResponseWriter, r *http.Request, key string, value interface{}) {
+	trace(r, "flash", key)
+	if err := s.validateKey(key); err != nil {
+		s.logf(LevelError, "failed to set flash: %v", err)
+		return
+	}
 
-	// Quiet defines whether or not to suppress all error and warning messages
-	// from the library. Defaults to false, since when correctly used, these
-	// messages should never appear. Setting to true may suppress critical
-	// error and warning messages.
-	Quiet bool
+	data := s.fromReq(r)
+	data.init()
+	data.setFlash(key, value)
+	data.RedirectFlashes = slices.DeleteFunc(data.RedirectFlashes, func(k string) bool {
+		return k == key
+	})
+	s.saveFlashCtx(w, r, data)
 }
 
-// New creates a new session manager with the given key.
-func New(secret []byte, opts ...Options) *Session {
-	var o Options
-	for _, opt := range opts {
-		o = opt
+// FlashAll sets all of the given flash messages on a request, saving the
+// session once. If any of the keys are invalid, the error is logged and none
+// of the flash messages are set.
+func (s *Session) FlashAll(w http.ResponseWriter, r *http.Request, values map[string]interface{}) {
+	for key := range values {
+		trace(r, "flash", key)
+		if err := s.validateKey(key); err != nil {
+			s.logf(LevelError, "failed to set flashes: %v", err)
+			return
+		}
 	}
 
-	if o.Name == "" {
-		o.Name = defaultSessionName
+	// Set the flashes in order of their keys, since the map has no order.
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
 	}
+	slices.Sort(keys)
 
-	switch o.MaxAge {
-	case 0:
-		// Default to one year, since some browsers don't set their cookies
-		// with the same defaults.
-		o.MaxAge = defaultMaxAge
-	case -1:
-		o.MaxAge = 0
+	data := s.fromReq(r)
+	data.init()
+	for _, key := range keys {
+		data.setFlash(key, values[key])
 	}
+	data.RedirectFlashes = slices.DeleteFunc(data.RedirectFlashes, func(k string) bool {
+		_, ok := values[k]
+		return ok
+	})
+	s.saveFlashCtx(w, r, data)
+}
 
-	sc := securecookie.New(secret, nil)
-	sc.MaxAge(o.MaxAge)
-	sc.SetSerializer(&cborSerializer{})
+// FlashForRedirect sets a flash message on a request that is only cleared
+// once it has been read in response to a GET request. This ensures the flash
+// survives a chain of redirects in the Post/Redirect/Get pattern, even if
+// the flashes are read by a handler for a request other than GET along the
+// way.
+func (s *Session) FlashForRedirect(w http.ResponseWriter, r *http.Request, key string, value interface{}) {
+	trace(r, "flash", key)
+	if err := s.validateKey(key); err != nil {
+		s.logf(LevelError, "failed to set flash: %v", err)
+		return
+	}
 
-	return &Session{
-		sc:    sc,
-		name:  o.Name,
-		quiet: o.Quiet,
+	data := s.fromReq(r)
+	data.init()
+	data.setFlash(key, value)
+	if !slices.Contains(data.RedirectFlashes, key) {
+		data.RedirectFlashes = append(data.RedirectFlashes, key)
 	}
+	s.saveFlashCtx(w, r, data)
 }
 
-// A session holds the session data. It contains two fields:
-//
-//   - "data" for long-lived session data that persists between requests,
-//   - "flashes" for session data that should be deleted as soon as it is shown.
-type session struct {
-	Data    map[string]interface{}
-	Flashes map[string]interface{}
+// Flashes returns all flash messages, clearing all saved flashes, except for
+// flashes set with FlashForRedirect when the request is not a GET request.
+func (s *Session) Flashes(w http.ResponseWriter, r *http.Request) map[string]interface{} {
+	data := s.fromReq(r)
+	values := data.consumeFlashes(r.Method)
+	s.saveFlashCtx(w, r, data)
+	return values
 }
 
-// init ensures that both of the underlying maps have been initialized.
-func (s *session) init() {
-	if s.Data == nil {
-		s.Data = make(map[string]interface{})
-	}
-	if s.Flashes == nil {
-		s.Flashes = make(map[string]interface{})
+// A FlashMessage is a flash message set with FlashWith, along with the
+// metadata attached to it, such as an icon name or an auto-dismiss timeout
+// for the frontend to use when rendering the message.
+type FlashMessage struct {
+	Value interface{}
+	Meta  map[string]string
+}
+
+// FlashWith sets a flash message on a request with the given metadata
+// attached to it. Use FlashMessages to read the value along with its
+// metadata.
+func (s *Session) FlashWith(w http.ResponseWriter, r *http.Request, key string, value interface{}, meta map[string]string) {
+	s.Flash(w, r, key, FlashMessage{Value: value, Meta: meta})
+}
+
+// FlashMessages returns all flash messages along with their metadata,
+// clearing flashes in the same way as Flashes. Flash messages set without
+// metadata are returned with a nil Meta.
+func (s *Session) FlashMessages(w http.ResponseWriter, r *http.Request) map[string]FlashMessage {
+	flashes := s.Flashes(w, r)
+	messages := make(map[string]FlashMessage, len(flashes))
+	for k, v := range flashes {
+		messages[k] = flashMessageOf(v)
 	}
+	return messages
 }
 
-// fromReq returns the map of session values from the request. It will
-// never return a nil map, instead, the map will be an initialized empty map
-// in the case where the session has no data.
-func (s *Session) fromReq(r *http.Request) *session {
-	// Fastpath: if the context has already been decoded, access the
-	// underlying map and return the value associated with the given key.
-	v := r.Context().Value(sessionCtxKey)
-	if v != nil {
-		ss, ok := v.(*session)
-		if ok {
-			return ss
-		}
+// flashMessageOf returns v as a FlashMessage. Once decoded from a cookie, a
+// FlashMessage is a map of its field names, so only maps with a Value and no
+// other fields than Meta are converted, and any other value is treated as a
+// flash without metadata.
+func flashMessageOf(v interface{}) FlashMessage {
+	if fm, ok := v.(FlashMessage); ok {
+		return fm
 	}
 
-	cookie, err := r.Cookie(s.name)
-	if err != nil {
-		// The only error that can be returned by r.Cookie() is ErrNoCookie,
-		// so if the error is not nil, that means that the cookie doesn't
-		// exist. When that is the case, the value associated with the given
-		// key is guaranteed to be nil, so we return nil.
-		ss := &session{}
-		ss.init()
-		return ss
+	m, ok := v.(map[interface{}]interface{})
+	if !ok || len(m) == 0 || len(m) > 2 {
+		return FlashMessage{Value: v}
+	}
+	if _, ok := m["Value"]; !ok {
+		return FlashMessage{Value: v}
+	}
+	if _, ok := m["Meta"]; len(m) == 2 && !ok {
+		return FlashMessage{Value: v}
 	}
 
-	ss := &session{}
-	if err := s.sc.Decode(s.name, cookie.Value, ss); err != nil {
-		if !s.quiet {
-			fmt.Printf("sessions: [ERROR] failed to decode session from cookie: %+v\n", err)
-		}
-		ss.init()
-		return ss
+	fm, ok := valueOf[FlashMessage](v)
+	if !ok {
+		return FlashMessage{Value: v}
 	}
-	return ss
+	return fm
 }
 
-// saveCtx saves a map of session data in the current request's context. It
-// also updates the Set-Cookie header of the
-func (s *Session) saveCtx(w http.ResponseWriter, r *http.Request, session *session) {
-	ctx := context.WithValue(r.Context(), sessionCtxKey, session)
-	r2 := r.Clone(ctx)
-	*r = *r2
+// A FlashOrder is the order in which DrainFlashes returns flash messages.
+type FlashOrder int
 
-	encoded, err := s.sc.Encode(s.name, session)
-	if err != nil {
-		if !s.quiet {
-			fmt.Printf("sessions: [ERROR} failed to encode cookie: %+v\n", err)
-		}
-		return
-	}
+const (
+	// FlashFIFO returns the flash messages that were set first first. It is
+	// the zero value, and therefore the default order.
+	FlashFIFO FlashOrder = iota
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     s.name,
-		MaxAge:   defaultMaxAge,
-		Expires:  time.Now().UTC().Add(time.Duration(defaultMaxAge * time.Second)),
-		Value:    encoded,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   true,
-	})
+	// FlashLIFO returns the flash messages that were set last first.
+	FlashLIFO
+)
+
+// A FlashEntry is a flash message returned by DrainFlashes, along with its
+// index in the order the flash messages were set.
+type FlashEntry struct {
+	Key   string
+	Value interface{}
+	Index int
 }
 
-// Session creates a new session from the given HTTP request. If the
-// request already has a cookie with an associated session, the session data
-// is created from the cookie. If not, a new session is created.
-func (s *Session) Get(r *http.Request, key string) interface{} {
+// DrainFlashes returns all flash messages, both as a list in the order given
+// by the FlashOrder option and as a map, clearing flashes in the same way as
+// Flashes. The index of each entry is its position in the list.
+func (s *Session) DrainFlashes(w http.ResponseWriter, r *http.Request) ([]FlashEntry, map[string]interface{}) {
 	data := s.fromReq(r)
-	return data.Data[key]
-}
+	keys := data.flashOrder()
+	if s.flashOrder == FlashLIFO {
+		slices.Reverse(keys)
+	}
+	values := data.consumeFlashes(r.Method)
+	s.saveFlashCtx(w, r, data)
 
-// List returns all key value pairs of session data from the given request.
-func (s *Session) List(r *http.Request) map[string]interface{} {
-	return s.fromReq(r).Data
+	entries := make([]FlashEntry, len(keys))
+	for i, k := range keys {
+		entries[i] = FlashEntry{Key: k, Value: values[k], Index: i}
+	}
+	return entries, values
 }
 
-// Set sets or updates the given value on the session.
-func (s *Session) Set(w http.ResponseWriter, r *http.Request, key string, value interface{}) {
+// FlashKeys returns the keys of the flash messages from the given request in
+// ascending order. Unlike Flashes, FlashKeys does not clear the flash
+// messages, so it can be used to check whether there are any flash messages
+// to show before they're read.
+func (s *Session) FlashKeys(r *http.Request) []string {
 	data := s.fromReq(r)
-	data.Data[key] = value
-	s.saveCtx(w, r, data)
+	keys := make([]string, 0, len(data.Flashes))
+	for k := range data.Flashes {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
 }
 
-// Delete deletes and returns the session value with the given key.
-func (s *Session) Delete(w http.ResponseWriter, r *http.Request, key string) interface{} {
+// CopyTo returns a shallow copy of dst with the session from src attached to
+// its context, such that session methods called with the returned request
+// see the same session data as src. This is useful when constructing an
+// outbound request from an incoming one, such as in a reverse proxy.
+func (s *Session) CopyTo(dst, src *http.Request) *http.Request {
+	ctx := s.withSession(dst.Context(), s.fromReq(src))
+	return dst.WithContext(ctx)
+}
+
+// ConsumeOnce records the given token in the session, returning true the
+// first time the token is seen and false every time after that. This can be
+// used with an idempotency key to guard against a form being submitted twice.
+//
+// Only the most recently consumed tokens are remembered in order to bound
+// the size of the session, so a token may be accepted again once enough
+// newer tokens have been consumed.
+func (s *Session) ConsumeOnce(w http.ResponseWriter, r *http.Request, token string) bool {
 	data := s.fromReq(r)
-	value := data.Data[key]
-	delete(data.Data, key)
+	for _, t := range data.Tokens {
+		if t == token {
+			return false
+		}
+	}
+
+	data.Tokens = append(data.Tokens, token)
+	if n := len(data.Tokens); n > maxOnceTokens {
+		data.Tokens = data.Tokens[n-maxOnceTokens:]
+	}
 	s.saveCtx(w, r, data)
-	return value
+	return true
 }
 
-// Reset resets the session, deleting all values.
-func (s *Session) Reset(w http.ResponseWriter, r *http.Request) {
-	s.saveCtx(w, r, &session{
-		Data:    make(map[string]interface{}),
-		Flashes: make(map[string]interface{}),
+// RequireSession returns middleware that redirects requests to the given URL
+// with a 303 See Other status when the session does not have a value for the
+// given key, for example, "user_id", and otherwise calls the next handler.
+func (s *Session) RequireSession(redirectURL string, key string) func(http.Handler) http.Handler {
+	return s.RequireSessionFunc(redirectURL, func(r *http.Request) bool {
+		return s.Has(r, key)
 	})
 }
 
-// Flash sets a flash message on a request.
-func (s *Session) Flash(w http.ResponseWriter, r *http.Request, key string, value interface{}) {
-	data := s.fromReq(r)
-	data.Flashes[key] = value
-	s.saveCtx(w, r, data)
+// RequireSessionFunc returns middleware that redirects requests to the given
+// URL with a 303 See Other status when the given function returns false, and
+// otherwise calls the next handler.
+func (s *Session) RequireSessionFunc(redirectURL string, fn func(r *http.Request) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !fn(r) {
+				http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
 }
 
-// Flashes returns all flash messages, clearing all saved flashes.
-func (s *Session) Flashes(w http.ResponseWriter, r *http.Request) map[string]interface{} {
-	data := s.fromReq(r)
+// writeTracker is a response writer that tracks whether the response's
+// headers have been written, and sets the session's cookies just before
+// they are.
+type writeTracker struct {
+	http.ResponseWriter
+	s       *Session
+	written bool
 
-	// Copy the map before clearing it from the session.
-	values := make(map[string]interface{})
-	for k, v := range data.Flashes {
-		values[k] = v
+	// session is the session to set as a cookie before the response is
+	// written, if it was modified, and flashOnly is whether only its flashes
+	// were modified. r is the request it was last modified with.
+	session   *session
+	flashOnly bool
+	r         *http.Request
+
+	// cache is the request's sessionCache, which holds the session to save
+	// again when it's due to be refreshed.
+	cache *sessionCache
+}
+
+// setPending defers setting the cookies for the given session until the
+// response is written.
+func (wt *writeTracker) setPending(r *http.Request, session *session, flashOnly bool) {
+	if wt.session == nil {
+		wt.flashOnly = flashOnly
+	} else {
+		wt.flashOnly = wt.flashOnly && flashOnly
+	}
+	wt.session = session
+	wt.r = r
+}
+
+// writeCookie sets the cookies for the modified session, if any.
+func (wt *writeTracker) writeCookie() {
+	session := wt.session
+	if session == nil {
+		session = wt.refreshed()
+	}
+	if session == nil || session.committed {
+		return
+	}
+	wt.session = nil
+
+	if err := wt.s.cookieSetter(wt.flashOnly)(wt.ResponseWriter, session); err != nil {
+		wt.s.logf(LevelError, "failed to encode cookie: %+v", err)
+		return
 	}
+	wt.s.saved(wt.r, session)
+}
 
-	data.Flashes = make(map[string]interface{})
+// refreshed returns the session from the request if it wasn't modified, but
+// needs to be saved again according to the RefreshAfter option, or nil.
+func (wt *writeTracker) refreshed() *session {
+	s := wt.s
+	if s.refreshAfter <= 0 || s.ephemeral || wt.cache == nil || s.skip(wt.r) {
+		return nil
+	}
 
-	s.saveCtx(w, r, data)
-	return values
+	ss := wt.cache.load(s, wt.r)
+	if ss.frozen || !s.needsRefresh(ss) {
+		return nil
+	}
+	s.bind(wt.r, ss)
+	return ss
+}
+
+func (wt *writeTracker) WriteHeader(statusCode int) {
+	if !wt.written {
+		wt.writeCookie()
+	}
+	wt.written = true
+	wt.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (wt *writeTracker) Write(data []byte) (int, error) {
+	if !wt.written {
+		wt.writeCookie()
+	}
+	wt.written = true
+	return wt.ResponseWriter.Write(data)
+}
+
+func (wt *writeTracker) Flush() {
+	if !wt.written {
+		wt.writeCookie()
+	}
+	wt.written = true
+	http.NewResponseController(wt.ResponseWriter).Flush()
+}
+
+// Unwrap returns the underlying response writer, for use with
+// http.ResponseController.
+func (wt *writeTracker) Unwrap() http.ResponseWriter {
+	return wt.ResponseWriter
+}
+
+// Middleware tracks whether the response has been written for any handler
+// wrapped by the middleware, so that a warning can be logged when the session
+// is modified after the response's headers have been written, at which point
+// the session cookie can no longer be set.
+//
+// The session cookie is set once, just before the handler writes the
+// response, rather than each time the session is modified. If the handler
+// doesn't write a response, the cookie is set once the handler returns.
+//
+// Unlike TemplMiddleware, the response is not buffered.
+func (s *Session) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cache := &sessionCache{}
+		r = r.WithContext(context.WithValue(r.Context(), cacheCtxKeyType{s: s}, cache))
+		wt := &writeTracker{ResponseWriter: w, s: s, r: r, cache: cache}
+		next.ServeHTTP(wt, r)
+		if !wt.written {
+			wt.writeCookie()
+		}
+	})
 }
 
 type responseWrapper struct {
@@ -339,6 +2708,14 @@ func (rw *responseWrapper) Flush() (int64, error) {
 // additional interface (i.e., `http.Hijacker`), you should skip those paths,
 // as the middleware inserts its own `http.ResponseWriter` that does not
 // implement those additional interfaces.
+//
+// The session cookie is only set on the response when the session was
+// changed by the handler, so requests that only read from the session don't
+// receive a Set-Cookie header.
+//
+// If the middleware is applied more than once for the same session, for
+// example, globally and for a single route, only the outermost middleware
+// decodes the session and buffers the response.
 func (s *Session) TemplMiddleware(next http.Handler, skipPaths ...string) http.Handler {
 	pool := &sync.Pool{
 		New: func() interface{} {
@@ -355,19 +2732,16 @@ func (s *Session) TemplMiddleware(next http.Handler, skipPaths ...string) http.H
 			}
 		}
 
-		// Get the session from the cookie, if it's present and valid.
-		session := &session{}
-		if cookie, err := r.Cookie(s.name); err != nil {
-			session.init()
-		} else {
-			if err := s.sc.Decode(s.name, cookie.Value, session); err != nil {
-				if !s.quiet {
-					fmt.Printf("sessions: [ERROR] failed to decode session from cookie: %+v\n", err)
-				}
-				session.init()
-			}
+		// Pass through if an outer TemplMiddleware is already handling the
+		// request, so that the response isn't buffered twice.
+		if r.Context().Value(templCtxKey) == s {
+			next.ServeHTTP(w, r)
+			return
 		}
 
+		// Get the session from the cookie, if it's present and valid.
+		session := s.decode(r)
+
 		// Create a response wrapper instance to execute the handler with.
 		b := pool.Get().(*bytes.Buffer)
 		b.Reset()
@@ -379,40 +2753,168 @@ func (s *Session) TemplMiddleware(next http.Handler, skipPaths ...string) http.H
 
 		// Set the session on the request's context so that it's accessible on
 		// the handler.
-		ctx := context.WithValue(r.Context(), sessionCtxKey, session)
+		ctx := s.withSession(r.Context(), session)
+		ctx = context.WithValue(ctx, templCtxKey, s)
+		cache := &sessionCache{ss: session}
+		ctx = context.WithValue(ctx, cacheCtxKeyType{s: s}, cache)
 
-		// Execute the handler.
+		// Execute the handler, and then save the latest session, since the
+		// handler may have replaced the session with a new one.
 		next.ServeHTTP(wrapper, r.WithContext(ctx))
+		session = cache.load(s, r)
 
-		// Encode the updated session so that we can set it as a cookie.
-		encoded, err := s.sc.Encode(s.name, session)
-		if err != nil {
-			if !s.quiet {
-				fmt.Printf("sessions: [ERROR} failed to encode cookie: %+v\n", err)
-			}
+		// Skip encoding the session and writing the response if the request
+		// was canceled, as the client is no longer around to receive it.
+		if err := ctx.Err(); err != nil {
+			s.logf(LevelDebug, "skipped saving session in call to sessions.TemplMiddleware: %v", err)
+			s.releaseBuffer(pool, b)
 			return
 		}
 
-		http.SetCookie(wrapper, &http.Cookie{
-			Name:     s.name,
-			MaxAge:   defaultMaxAge,
-			Expires:  time.Now().UTC().Add(time.Duration(defaultMaxAge * time.Second)),
-			Value:    encoded,
-			Path:     "/",
-			HttpOnly: true,
-			Secure:   true,
-		})
+		// Encode the updated session and set it as a cookie, unless the
+		// session is unchanged, in which case the cookie the request was
+		// sent with is still current. A session read from a fallback name is
+		// always saved in order to move it to the primary name, and one
+		// that's due to be refreshed is saved so that its cookie doesn't
+		// expire while it's in use.
+		if !s.ephemeral && !session.committed && (session.changed || session.from != "" || s.needsRefresh(session)) && !s.skip(r) {
+			s.checkDomain(r)
+			s.bind(r, session)
+			if err := s.setCookie(wrapper, session); err != nil {
+				s.logf(LevelError, "failed to encode cookie: %+v", err)
+				return
+			}
+			s.saved(r, session)
+		}
 
 		if _, err := wrapper.Flush(); err != nil {
-			if !s.quiet {
-				fmt.Printf("sessions: [ERROR] failed to write http response in call to sessions.TemplMiddleware: %v\n", err)
-			}
+			s.logf(LevelError, "failed to write http response in call to sessions.TemplMiddleware: %v", err)
 		}
 
-		pool.Put(b)
+		s.releaseBuffer(pool, b)
 	})
 }
 
+// releaseBuffer returns the given response buffer to the pool, unless it grew
+// larger than the MaxBufferReuseSize option, in which case it's discarded.
+func (s *Session) releaseBuffer(pool *sync.Pool, b *bytes.Buffer) {
+	if s.maxBufferReuse >= 0 && b.Cap() > s.maxBufferReuse {
+		return
+	}
+	pool.Put(b)
+}
+
+// SizeInfo describes how the size of the encoded session changed during a
+// request.
+type SizeInfo struct {
+	// Before is the size in bytes of the session cookie the request was sent
+	// with, or zero if the request had no session cookie.
+	Before int
+
+	// After is the size in bytes of the session cookie if the session were
+	// saved at the time SizeInfoCtx was called.
+	After int
+}
+
+// SizeInfoCtx returns the size of the encoded session when the request was
+// received, and the size it would be encoded as now, for the given context.
+// This can be used to find the handlers that grow the session, for example,
+// by logging the sizes at the end of each handler.
+//
+// Like FlashesCtx, it requires the use of the sessions.TemplMiddleware, which
+// ensures that every incoming request has the session data decoded into the
+// context. The returned SizeInfo is zero if the session is missing from the
+// context or can't be encoded.
+func (s *Session) SizeInfoCtx(ctx context.Context) SizeInfo {
+	ss, ok := s.sessionCtx(ctx)
+	if !ok {
+		s.logf(LevelWarning, "SizeInfoCtx was called but the session is nil - did you remember to wrap your handler in sessions.TemplMiddleware?")
+		return SizeInfo{}
+	}
+
+	encoded, err := s.encode(s.name, ss)
+	if err != nil {
+		s.logf(LevelError, "failed to encode cookie: %+v", err)
+		return SizeInfo{}
+	}
+	return SizeInfo{Before: ss.size, After: len(encoded)}
+}
+
+// ChangesCtx returns the keys of the session data that were added, modified,
+// and removed since the request was received, for the given context, each
+// sorted in ascending order. This can be used to keep an audit trail of
+// changes to the session, for example, by logging the changes at the end of
+// each handler.
+//
+// Like FlashesCtx, it requires the use of the sessions.TemplMiddleware, which
+// ensures that every incoming request has the session data decoded into the
+// context.
+func (s *Session) ChangesCtx(ctx context.Context) (added, modified, removed []string) {
+	ss, ok := s.sessionCtx(ctx)
+	if !ok {
+		s.logf(LevelWarning, "ChangesCtx was called but the session is nil - did you remember to wrap your handler in sessions.TemplMiddleware?")
+		return nil, nil, nil
+	}
+
+	// Decode the cookie the request was sent with again, rather than copying
+	// the session data up front, so that requests that don't check their
+	// changes don't pay for a copy.
+	var original map[string]interface{}
+	if ss.cookie != nil {
+		initial, err := s.decodeValue(ss.cookie.Name, ss.cookie.Value)
+		if err != nil {
+			if legacy, ok := s.decodeLegacy(ss.cookie.Name, ss.cookie.Value); ok {
+				initial, err = legacy, nil
+			}
+		}
+		if err != nil {
+			s.logf(LevelError, "failed to decode session from cookie: %+v", err)
+			return nil, nil, nil
+		}
+		original = initial.Data
+	}
+
+	for k, v := range ss.Data {
+		ov, ok := original[k]
+		switch {
+		case !ok:
+			added = append(added, k)
+		case !sameValue(ov, v):
+			modified = append(modified, k)
+		}
+	}
+	for k := range original {
+		if _, ok := ss.Data[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+
+	slices.Sort(added)
+	slices.Sort(modified)
+	slices.Sort(removed)
+	return added, modified, removed
+}
+
+// canonicalEncMode encodes values with their map keys sorted, such that
+// equal values always have the same encoding.
+var canonicalEncMode, _ = cbor.EncOptions{Sort: cbor.SortCanonical}.EncMode()
+
+// sameValue reports whether a and b are the same session value. Values are
+// compared by their encoding, since a decoded value doesn't always have the
+// same type as the value that was set, for example, an int is decoded as a
+// uint64.
+func sameValue(a, b interface{}) bool {
+	ab, err := canonicalEncMode.Marshal(a)
+	if err != nil {
+		return reflect.DeepEqual(a, b)
+	}
+	bb, err := canonicalEncMode.Marshal(b)
+	if err != nil {
+		return reflect.DeepEqual(a, b)
+	}
+	return bytes.Equal(ab, bb)
+}
+
 // FlashesCtx returns all flash messages as a map[string]interace{} for the
 // given context.
 //
@@ -429,24 +2931,15 @@ func (s *Session) TemplMiddleware(next http.Handler, skipPaths ...string) http.H
 //		<div>{ key }: { fmt.Sprintf("%v", val) }</div>
 //	}
 func (s *Session) FlashesCtx(ctx context.Context) map[string]interface{} {
-	flashes := make(map[string]interface{})
-	v := ctx.Value(sessionCtxKey)
-
-	if v != nil {
-		ss, ok := v.(*session)
-		if ok {
-			for k, v := range ss.Flashes {
-				flashes[k] = v
-			}
-			clear(ss.Flashes)
-			return flashes
+	if ss, ok := s.sessionCtx(ctx); ok {
+		if ss.frozen {
+			ss = ss.clone()
 		}
+		return ss.consumeFlashes(ss.method)
 	}
 
-	if !s.quiet {
-		fmt.Printf("sessions: [WARNING] FlashesCtx was called but the session is nil - did you remember to wrap your handler in sessions.TemplMiddleware?\n")
-	}
-	return flashes
+	s.logf(LevelWarning, "FlashesCtx was called but the session is nil - did you remember to wrap your handler in sessions.TemplMiddleware?")
+	return make(map[string]interface{})
 }
 
 // FlashesCtx returns all flash messages as a map[string]interace{} for the
@@ -465,18 +2958,16 @@ func (s *Session) FlashesCtx(ctx context.Context) map[string]interface{} {
 //		<div>{ key }: { fmt.Sprintf("%v", val) }</div>
 //	}
 func FlashesCtx(ctx context.Context) map[string]interface{} {
-	flashes := make(map[string]interface{})
 	v := ctx.Value(sessionCtxKey)
 
 	if v != nil {
 		ss, ok := v.(*session)
 		if ok {
-			for k, v := range ss.Flashes {
-				flashes[k] = v
+			if ss.frozen {
+				ss = ss.clone()
 			}
-			clear(ss.Flashes)
-			return flashes
+			return ss.consumeFlashes(ss.method)
 		}
 	}
-	return flashes
+	return make(map[string]interface{})
 }
@@ -1,14 +1,28 @@
 package sessions
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"maps"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
 )
 
 func ExampleSession() {
@@ -76,6 +90,93 @@ func ExampleSession() {
 	})
 }
 
+func TestNewFromCodec(t *testing.T) {
+	t.Parallel()
+
+	sc := securecookie.New(GenerateRandomKey(32), GenerateRandomKey(32))
+	sc.SetSerializer(securecookie.JSONEncoder{})
+	sc.MaxLength(8192)
+
+	s := NewFromCodec(sc)
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Set(rr, req, "name", "Ben")
+
+	// Confirm the cookie is encoded by the codec.
+	cookie := rr.Result().Cookies()[0]
+	var ss session
+	if err := sc.Decode("_session", cookie.Value, &ss); err != nil {
+		t.Fatalf("expected cookie to be decoded by the codec but got %v", err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+
+	if v := s.Get(req, "name"); v != "Ben" {
+		t.Fatalf("expected Ben but got %v", v)
+	}
+}
+
+// TestNewFromCodecWithoutGob doesn't run in parallel, so that it runs before
+// any of the parallel tests have created a session manager that registers
+// the package's types with gob.
+func TestNewFromCodecWithoutGob(t *testing.T) {
+	registered := gobRegistered.Load()
+
+	sc := securecookie.New(GenerateRandomKey(32), nil)
+	sc.SetSerializer(securecookie.JSONEncoder{})
+	s := NewFromCodec(sc, Options{SkipGobRegistration: true})
+	New(GenerateRandomKey(32))
+
+	rr := httptest.NewRecorder()
+	s.Set(rr, httptest.NewRequest(http.MethodGet, "/", nil), "name", "Ben")
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(rr.Result().Cookies()[0])
+	if v := s.Get(req, "name"); v != "Ben" {
+		t.Fatalf("expected Ben but got %v", v)
+	}
+
+	if !registered && gobRegistered.Load() {
+		t.Fatal("expected types not to be registered with gob")
+	}
+}
+
+func TestSessionInvalidKeys(t *testing.T) {
+	t.Parallel()
+
+	for _, n := range []int{1, 15, 17, 31, 33, 64} {
+		buf := &bytes.Buffer{}
+		NewFromCodec(securecookie.New(GenerateRandomKey(32), GenerateRandomKey(n)), Options{
+			Logger: log.New(buf, "", 0),
+		})
+		if logs := buf.String(); !strings.Contains(logs, fmt.Sprintf("invalid key size %d", n)) {
+			t.Fatalf("expected invalid block key error for a %d byte key but got %q", n, logs)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	NewFromCodec(securecookie.New(GenerateRandomKey(32), GenerateRandomKey(32)), Options{
+		Logger: log.New(buf, "", 0),
+	})
+	if logs := buf.String(); logs != "" {
+		t.Fatalf("expected no errors for a 32 byte block key but got %q", logs)
+	}
+
+	buf = &bytes.Buffer{}
+	New(nil, Options{Logger: log.New(buf, "", 0)})
+	if logs := buf.String(); !strings.HasPrefix(logs, "sessions: [ERROR] failed to encode session") || !strings.Contains(logs, "hash key is not set") {
+		t.Fatalf("expected missing hash key error but got %q", logs)
+	}
+
+	if s, err := NewWithError(nil); s != nil || err == nil {
+		t.Fatalf("expected an error for a missing hash key but got %v, %v", s, err)
+	}
+	if _, err := NewWithError(GenerateRandomKey(32)); err != nil {
+		t.Fatalf("expected no error but got %v", err)
+	}
+}
+
 func TestSessionGetNonNil(t *testing.T) {
 	t.Parallel()
 
@@ -116,6 +217,109 @@ func TestSessionSetGet(t *testing.T) {
 	})
 }
 
+func TestSessionSameSite(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32), Options{DeleteWhenEmpty: true})
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Set(rr, req, "key", "value")
+	s.Reset(rr, req)
+
+	for _, h := range rr.Result().Header["Set-Cookie"] {
+		if !strings.Contains(h, "SameSite=Lax") {
+			t.Fatalf("expected SameSite=Lax in %s", h)
+		}
+	}
+}
+
+func TestSessionTrySetInvalidKey(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32), Options{MaxKeyLength: 8, Quiet: true})
+
+	cases := []struct {
+		name string
+		key  string
+	}{
+		{name: "empty key", key: ""},
+		{name: "over-long key", key: "123456789"},
+		{name: "reserved prefix", key: reservedPrefix + "user"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+			if err := s.TrySet(rr, req, c.key, "value"); !errors.Is(err, ErrInvalidKey) {
+				t.Fatalf("expected ErrInvalidKey but got %v", err)
+			}
+			if s.Has(req, c.key) {
+				t.Fatalf("expected invalid key %q not to be set", c.key)
+			}
+			if h := rr.Header().Get("Set-Cookie"); h != "" {
+				t.Fatalf("expected no Set-Cookie header but got %s", h)
+			}
+
+			s.Flash(rr, req, c.key, "value")
+			if flashes := s.Flashes(rr, req); len(flashes) != 0 {
+				t.Fatalf("expected invalid flash key %q not to be set but got %v", c.key, flashes)
+			}
+		})
+	}
+
+	t.Run("valid key", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		if err := s.TrySet(rr, req, "12345678", "value"); err != nil {
+			t.Fatalf("expected no error but got %v", err)
+		}
+		if v := s.Get(req, "12345678"); v != "value" {
+			t.Fatalf("expected value but got %v", v)
+		}
+	})
+}
+
+func TestSessionMaxKeys(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32), Options{MaxKeys: 2, Quiet: true})
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Set(rr, req, "a", 1)
+	s.Set(rr, req, "b", 2)
+
+	if err := s.TrySet(rr, req, "c", 3); !errors.Is(err, ErrTooManyKeys) {
+		t.Fatalf("expected ErrTooManyKeys but got %v", err)
+	}
+	if s.Has(req, "c") {
+		t.Fatal("expected new key over the limit not to be set")
+	}
+
+	s.AppendToList(rr, req, "d", 4, 0)
+	s.Namespace("e").Set(rr, req, "key", 5)
+	if n := len(s.List(req)); n != 2 {
+		t.Fatalf("expected 2 keys but got %d", n)
+	}
+
+	if err := s.TrySet(rr, req, "a", 10); err != nil {
+		t.Fatalf("expected existing key to be updated but got %v", err)
+	}
+	if v := s.Get(req, "a"); v != 10 {
+		t.Fatalf("expected 10 but got %v", v)
+	}
+
+	// Deleting a key makes room for a new one.
+	s.Delete(rr, req, "b")
+	if err := s.TrySet(rr, req, "c", 3); err != nil {
+		t.Fatalf("expected new key to be set after deleting a key but got %v", err)
+	}
+}
+
 func TestSessionList(t *testing.T) {
 	t.Parallel()
 
@@ -135,6 +339,45 @@ func TestSessionList(t *testing.T) {
 	}
 }
 
+func TestSessionAppendToList(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+
+	t.Run("append to an empty list", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		s.AppendToList(rr, req, "viewed", "a", 3)
+
+		expected := []interface{}{"a"}
+		if v := s.Get(req, "viewed"); !reflect.DeepEqual(v, expected) {
+			t.Fatalf("expected %v but got %v", expected, v)
+		}
+	})
+
+	t.Run("trim to the most recent values", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		for _, v := range []string{"a", "b", "c"} {
+			s.AppendToList(rr, req, "viewed", v, 3)
+		}
+
+		// Read the list back from the cookie before appending past the max.
+		cookies := rr.Result().Cookies()
+		req = httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(cookies[len(cookies)-1])
+
+		s.AppendToList(httptest.NewRecorder(), req, "viewed", "d", 3)
+
+		expected := []interface{}{"b", "c", "d"}
+		if v := s.Get(req, "viewed"); !reflect.DeepEqual(v, expected) {
+			t.Fatalf("expected %v but got %v", expected, v)
+		}
+	})
+}
+
 func TestSessionDelete(t *testing.T) {
 	t.Parallel()
 
@@ -173,47 +416,2353 @@ func TestSessionDelete(t *testing.T) {
 	}
 }
 
-func TestSessionReset(t *testing.T) {
+func TestSessionWithPrefix(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Set(rr, req, "cart:items", 2)
+	s.Set(rr, req, "cart:total", "10.00")
+	s.Set(rr, req, "user:id", "1")
+
+	values := s.WithPrefix(req, "cart:")
+	if len(values) != 2 {
+		t.Fatalf("expected 2 values but got %v", values)
+	}
+	if v := values["cart:total"]; v != "10.00" {
+		t.Fatalf("expected 10.00 but got %v", v)
+	}
+	if _, ok := values["user:id"]; ok {
+		t.Fatal("expected user:id to be filtered out")
+	}
+}
+
+func TestSessionDeletePrefix(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Set(httptest.NewRecorder(), req, "cart:items", 2)
+	s.Set(httptest.NewRecorder(), req, "cart:total", "10.00")
+	s.Set(httptest.NewRecorder(), req, "user:id", "1")
+
+	rr := httptest.NewRecorder()
+	s.DeletePrefix(rr, req, "cart:")
+
+	if n := len(rr.Result().Header["Set-Cookie"]); n != 1 {
+		t.Fatalf("expected 1 Set-Cookie header but got %d", n)
+	}
+	if values := s.WithPrefix(req, "cart:"); len(values) != 0 {
+		t.Fatalf("expected no cart values but got %v", values)
+	}
+	if v := s.Get(req, "user:id"); v != "1" {
+		t.Fatalf("expected 1 but got %v", v)
+	}
+}
+
+func TestSessionReset(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Set(rr, req, "key", "value")
+	v := s.Get(req, "key")
+	if v == nil {
+		t.Fatal("got nil")
+	}
+
+	s.Reset(rr, req)
+	v = s.Get(req, "key")
+	if v != nil {
+		t.Fatalf("expected nil, got %v", v)
+	}
+}
+
+func TestSessionSetExpiry(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+	s.Set(rr, req, "key", "value")
+	rr = httptest.NewRecorder()
+	s.SetExpiry(rr, req, at)
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie but got %d", len(cookies))
+	}
+	cookie := cookies[0]
+	if !cookie.Expires.Equal(at) {
+		t.Fatalf("expected cookie to expire at %s but got %s", at, cookie.Expires)
+	}
+	if cookie.MaxAge <= 3590 || cookie.MaxAge > 3600 {
+		t.Fatalf("expected cookie max age to be about one hour but got %d", cookie.MaxAge)
+	}
+
+	// Confirm the expiry is kept when the session is saved again.
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+	rr = httptest.NewRecorder()
+	s.Set(rr, req, "other", "value")
+
+	if c := rr.Result().Cookies()[0]; !c.Expires.Equal(at) {
+		t.Fatalf("expected cookie to expire at %s but got %s", at, c.Expires)
+	}
+}
+
+func TestSessionSetExpiryPast(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32), Options{Quiet: true})
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Set(rr, req, "key", "value")
+	rr = httptest.NewRecorder()
+	s.SetExpiry(rr, req, time.Now().Add(-time.Minute))
+
+	cookie := rr.Result().Cookies()[0]
+	if cookie.MaxAge != -1 {
+		t.Fatalf("expected cookie max age to be -1 but got %d", cookie.MaxAge)
+	}
+
+	// Even if the browser keeps sending the cookie, the expired session is
+	// not accepted.
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+
+	if v := s.Get(req, "key"); v != nil {
+		t.Fatalf("expected expired session to be empty but got %v", v)
+	}
+	if err := s.Err(req); !errors.Is(err, ErrExpired) {
+		t.Fatalf("expected ErrExpired but got %v", err)
+	}
+}
+
+func TestSessionResetExcept(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Set(rr, req, "user_id", "1")
+	s.Set(rr, req, "locale", "en")
+	s.Set(rr, req, "theme", "dark")
+	s.Flash(rr, req, "notice", "saved")
+
+	rr = httptest.NewRecorder()
+	s.ResetExcept(rr, req, "locale", "theme", "missing")
+
+	cookies := rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+
+	want := map[string]interface{}{"locale": "en", "theme": "dark"}
+	if values := s.List(req); !reflect.DeepEqual(values, want) {
+		t.Fatalf("expected %v but got %v", want, values)
+	}
+	if flashes := s.Flashes(httptest.NewRecorder(), req); len(flashes) != 0 {
+		t.Fatalf("expected flashes to be reset but got %v", flashes)
+	}
+}
+
+func TestSessionResetFlashes(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Set(rr, req, "key", "value")
+	s.Flash(rr, req, "flash", "value")
+	s.FlashForRedirect(rr, req, "redirect", "value")
+
+	rr = httptest.NewRecorder()
+	s.ResetFlashes(rr, req)
+
+	if n := len(rr.Result().Header["Set-Cookie"]); n != 1 {
+		t.Fatalf("expected 1 Set-Cookie header but got %d", n)
+	}
+	if v := s.Get(req, "key"); v != "value" {
+		t.Fatalf("expected value but got %v", v)
+	}
+	if flashes := s.Flashes(rr, req); len(flashes) != 0 {
+		t.Fatalf("expected no flashes but got %v", flashes)
+	}
+}
+
+func TestSessionFlashes(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Flash(rr, req, "flash1", "value1")
+	s.Flash(rr, req, "flash2", "value2")
+
+	values1 := s.Flashes(rr, req)
+	values2 := s.Flashes(rr, req)
+
+	if v := values1["flash1"].(string); v != "value1" {
+		t.Fatalf("expected value1, got %s", v)
+	}
+	if v := values1["flash2"].(string); v != "value2" {
+		t.Fatalf("expected value2, got %s", v)
+	}
+	if len(values2) != 0 {
+		t.Fatalf("expected empty initialized session but got %v", values2)
+	}
+}
+
+func TestSessionDeleteWhenEmpty(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32), Options{DeleteWhenEmpty: true})
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Set(rr, req, "key", "value")
+	s.Reset(rr, req)
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 2 {
+		t.Fatalf("expected 2 cookies but got %d", len(cookies))
+	}
+	if v := cookies[0].Value; v == "" {
+		t.Fatal("expected first cookie to hold an encoded session")
+	}
+
+	cookie := cookies[1]
+	if cookie.Name != "_session" {
+		t.Fatalf("expected cookie named _session but got %s", cookie.Name)
+	}
+	if cookie.Value != "" {
+		t.Fatalf("expected deletion cookie to be empty but got %s", cookie.Value)
+	}
+	if cookie.MaxAge != -1 {
+		t.Fatalf("expected deletion cookie to have MaxAge -1 but got %d", cookie.MaxAge)
+	}
+	if !cookie.Expires.Before(time.Now()) {
+		t.Fatalf("expected deletion cookie to expire in the past but got %s", cookie.Expires)
+	}
+}
+
+func TestSessionDeleteWhenEmptyWithoutCookie(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32), Options{DeleteWhenEmpty: true})
+
+	// Anonymous requests without a session cookie get no cookie at all.
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.Flashes(rr, req)
+	s.Delete(rr, req, "key")
+	s.Reset(rr, req)
+	if h := rr.Header().Values("Set-Cookie"); len(h) != 0 {
+		t.Fatalf("expected no Set-Cookie headers but got %v", h)
+	}
+
+	// A request with a session cookie still has it deleted.
+	rr = httptest.NewRecorder()
+	s.Set(rr, httptest.NewRequest(http.MethodGet, "/", nil), "key", "value")
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(rr.Result().Cookies()[0])
+
+	rr = httptest.NewRecorder()
+	s.Reset(rr, req)
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "_session" || cookies[0].MaxAge != -1 {
+		t.Fatalf("expected a deletion cookie but got %v", cookies)
+	}
+}
+
+func TestSessionDuplicateCookies(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	s := New(GenerateRandomKey(32), Options{
+		Logger:   log.New(buf, "", 0),
+		LogLevel: LevelWarning,
+	})
+
+	rr := httptest.NewRecorder()
+	s.Set(rr, httptest.NewRequest(http.MethodGet, "/", nil), "key", "value")
+	valid := rr.Result().Cookies()[0]
+
+	// Send a stale cookie that can't be decoded before the valid one.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "_session", Value: "stale"})
+	req.AddCookie(valid)
+
+	if v := s.Get(req, "key"); v != "value" {
+		t.Fatalf("expected value from the valid cookie but got %v", v)
+	}
+	if !s.Verify(req) {
+		t.Fatal("expected the valid cookie to be verified")
+	}
+	if logs := buf.String(); !strings.HasPrefix(logs, "sessions: [WARNING] found 2 cookies named _session") {
+		t.Fatalf("expected duplicate cookie warning but got %q", logs)
+	}
+}
+
+func TestSessionFallbackNames(t *testing.T) {
+	t.Parallel()
+
+	secret := GenerateRandomKey(32)
+	old := New(secret)
+	s := New(secret, Options{
+		Name:          "__Host-session",
+		FallbackNames: []string{"_session"},
+	})
+
+	// Save a session under the old cookie name.
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	old.Set(rr, req, "key", "value")
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(rr.Result().Cookies()[0])
+
+	if v := s.Get(req, "key"); v != "value" {
+		t.Fatalf("expected value from fallback cookie but got %v", v)
+	}
+
+	rr = httptest.NewRecorder()
+	s.Set(rr, req, "other", "value")
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 2 {
+		t.Fatalf("expected 2 cookies but got %d", len(cookies))
+	}
+	if c := cookies[0]; c.Name != "_session" || c.MaxAge != -1 {
+		t.Fatalf("expected deletion cookie for _session but got %s", c)
+	}
+	if c := cookies[1]; c.Name != "__Host-session" || c.Value == "" {
+		t.Fatalf("expected session cookie for __Host-session but got %s", c)
+	}
+
+	// Confirm the cookie under the new name holds the migrated session.
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[1])
+
+	if v := s.Get(req, "key"); v != "value" {
+		t.Fatalf("expected value from new cookie but got %v", v)
+	}
+}
+
+func TestSessionFallbackNamesReset(t *testing.T) {
+	t.Parallel()
+
+	secret := GenerateRandomKey(32)
+	old := New(secret)
+	s := New(secret, Options{
+		Name:            "__Host-session",
+		FallbackNames:   []string{"_session"},
+		DeleteWhenEmpty: true,
+	})
+
+	rr := httptest.NewRecorder()
+	old.Set(rr, httptest.NewRequest(http.MethodGet, "/", nil), "user", "alice")
+	fallback := rr.Result().Cookies()[0]
+
+	for name, replace := range map[string]func(w http.ResponseWriter, r *http.Request){
+		"reset":        s.Reset,
+		"reset except": func(w http.ResponseWriter, r *http.Request) { s.ResetExcept(w, r, "theme") },
+		"login":        func(w http.ResponseWriter, r *http.Request) { s.Login(w, r, "42") },
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(fallback)
+		rr := httptest.NewRecorder()
+		replace(rr, req)
+
+		var deleted bool
+		for _, c := range rr.Result().Cookies() {
+			deleted = deleted || c.Name == "_session" && c.MaxAge == -1
+		}
+		if !deleted {
+			t.Fatalf("expected %s to delete the fallback cookie but got %v", name, rr.Result().Cookies())
+		}
+	}
+}
+
+// base64Transformer base64 encodes the value stored under its key.
+type base64Transformer struct {
+	key string
+}
+
+func (bt *base64Transformer) OnWrite(key string, v interface{}) (interface{}, error) {
+	if key != bt.key {
+		return v, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected string but got %T", v)
+	}
+	return base64.StdEncoding.EncodeToString([]byte(s)), nil
+}
+
+func (bt *base64Transformer) OnRead(key string, v interface{}) (interface{}, error) {
+	if key != bt.key {
+		return v, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected string but got %T", v)
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	return string(b), err
+}
+
+func TestSessionTransformer(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32), Options{
+		Transformer: &base64Transformer{key: "email"},
+	})
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Set(rr, req, "email", "ben@example.com")
+	s.Set(rr, req, "name", "Ben")
+
+	// Confirm the values round-trip through a cookie.
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	cookies := rr.Result().Cookies()
+	req.AddCookie(cookies[len(cookies)-1])
+
+	if v := s.Get(req, "email"); v != "ben@example.com" {
+		t.Fatalf("expected ben@example.com but got %v", v)
+	}
+	if v := s.Get(req, "name"); v != "Ben" {
+		t.Fatalf("expected Ben but got %v", v)
+	}
+
+	// Confirm only the transformed key is stored encoded.
+	data := s.List(req)
+	if v := data["email"]; v != "YmVuQGV4YW1wbGUuY29t" {
+		t.Fatalf("expected stored email to be base64 encoded but got %v", v)
+	}
+	if v := data["name"]; v != "Ben" {
+		t.Fatalf("expected stored name to be Ben but got %v", v)
+	}
+}
+
+func TestSessionReadThenWrite(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	if v := s.Get(req, "key"); v != nil {
+		t.Fatalf("expected nil but got %v", v)
+	}
+	if data := s.List(req); data == nil || len(data) != 0 {
+		t.Fatalf("expected empty non-nil map but got %#v", data)
+	}
+	if flashes := s.Flashes(rr, req); len(flashes) != 0 {
+		t.Fatalf("expected no flashes but got %v", flashes)
+	}
+
+	s.Set(rr, req, "key", "value")
+	s.Flash(rr, req, "flash", "message")
+
+	if v := s.Get(req, "key"); v != "value" {
+		t.Fatalf("expected value but got %v", v)
+	}
+	if v := s.Flashes(rr, req)["flash"]; v != "message" {
+		t.Fatalf("expected message but got %v", v)
+	}
+}
+
+func TestSessionCopyTo(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	src := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Set(rr, src, "key", "value")
+
+	dst := s.CopyTo(httptest.NewRequest(http.MethodGet, "/proxied", nil), src)
+	if v := s.Get(dst, "key"); v != "value" {
+		t.Fatalf("expected value but got %v", v)
+	}
+	if dst.URL.Path != "/proxied" {
+		t.Fatalf("expected copied request to keep its path but got %s", dst.URL.Path)
+	}
+}
+
+func TestSessionConsumeOnce(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	if !s.ConsumeOnce(rr, req, "token") {
+		t.Fatal("expected first use of token to return true")
+	}
+
+	// Confirm the token is remembered across requests.
+	cookies := rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+
+	rr = httptest.NewRecorder()
+	if s.ConsumeOnce(rr, req, "token") {
+		t.Fatal("expected second use of token to return false")
+	}
+	if h := rr.Header().Get("Set-Cookie"); h != "" {
+		t.Fatalf("expected no Set-Cookie header for a repeated token but got %s", h)
+	}
+}
+
+func TestSessionConsumeOnceEviction(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	for i := 0; i <= maxOnceTokens; i++ {
+		if !s.ConsumeOnce(rr, req, fmt.Sprintf("token-%d", i)) {
+			t.Fatalf("expected first use of token-%d to return true", i)
+		}
+	}
+
+	// The most recent token is still remembered, but the oldest has been
+	// evicted.
+	if s.ConsumeOnce(rr, req, fmt.Sprintf("token-%d", maxOnceTokens)) {
+		t.Fatal("expected most recent token to return false")
+	}
+	if !s.ConsumeOnce(rr, req, "token-0") {
+		t.Fatal("expected evicted token to return true")
+	}
+}
+
+func TestSessionAll(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Set(rr, req, "key", "value")
+	s.Flash(rr, req, "flash", "message")
+
+	cookies := rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+
+	all := s.All(req)
+	if v := all.Data["key"]; v != "value" {
+		t.Fatalf("expected value but got %v", v)
+	}
+	if v := all.Flashes["flash"]; v != "message" {
+		t.Fatalf("expected message but got %v", v)
+	}
+
+	// The flashes are not cleared.
+	if v := s.Flashes(httptest.NewRecorder(), req)["flash"]; v != "message" {
+		t.Fatalf("expected flash to remain but got %v", v)
+	}
+}
+
+func TestSessionHas(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	if s.Has(req, "key") {
+		t.Fatal("expected key not to be present")
+	}
+
+	s.Set(rr, req, "key", nil)
+	if !s.Has(req, "key") {
+		t.Fatal("expected key with nil value to be present")
+	}
+}
+
+func TestSessionRequireSession(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+
+	h := s.RequireSession("/login", "user_id")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, world!"))
+	}))
+
+	t.Run("unauthenticated requests are redirected", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Fatalf("expected status %d but got %d", http.StatusSeeOther, rr.Code)
+		}
+		if loc := rr.Header().Get("Location"); loc != "/login" {
+			t.Fatalf("expected redirect to /login but got %s", loc)
+		}
+	})
+
+	t.Run("authenticated requests are passed through", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		s.Set(httptest.NewRecorder(), req, "user_id", "1")
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d but got %d", http.StatusOK, rr.Code)
+		}
+		if body := rr.Body.String(); body != "Hello, world!" {
+			t.Fatalf("expected Hello, world! but got %s", body)
+		}
+	})
+}
+
+func TestSessionRequireSessionFunc(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+
+	h := s.RequireSessionFunc("/login", func(r *http.Request) bool {
+		return s.Get(r, "role") == "admin"
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.Set(httptest.NewRecorder(), req, "role", "member")
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("expected status %d but got %d", http.StatusSeeOther, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	s.Set(httptest.NewRecorder(), req, "role", "admin")
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d but got %d", http.StatusNoContent, rr.Code)
+	}
+}
+
+func TestSessionFlashForRedirect(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+
+	// next sends a request with the session cookie from the previous
+	// response.
+	next := func(method string, rr *httptest.ResponseRecorder) *http.Request {
+		req := httptest.NewRequest(method, "/", nil)
+		cookies := rr.Result().Cookies()
+		req.AddCookie(cookies[len(cookies)-1])
+		return req
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	s.FlashForRedirect(rr, req, "notice", "Saved")
+	s.Flash(rr, req, "other", "Saved")
+
+	// A request other than GET reading the flashes along the redirect chain
+	// only clears the regular flash.
+	req = next(http.MethodPost, rr)
+	rr = httptest.NewRecorder()
+	flashes := s.Flashes(rr, req)
+	if len(flashes) != 2 {
+		t.Fatalf("expected 2 flashes but got %v", flashes)
+	}
+
+	// The final GET request receives the flash.
+	req = next(http.MethodGet, rr)
+	rr = httptest.NewRecorder()
+	flashes = s.Flashes(rr, req)
+	if len(flashes) != 1 || flashes["notice"] != "Saved" {
+		t.Fatalf("expected only the redirect flash but got %v", flashes)
+	}
+
+	// The flash is cleared once delivered to a GET request.
+	req = next(http.MethodGet, rr)
+	rr = httptest.NewRecorder()
+	if flashes := s.Flashes(rr, req); len(flashes) != 0 {
+		t.Fatalf("expected no flashes but got %v", flashes)
+	}
+}
+
+func TestSessionSeparateFlashCookie(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32), Options{SeparateFlashCookie: true})
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Set(rr, req, "key", "value")
+	s.Flash(rr, req, "notice", "Hello")
+
+	cookies := make(map[string]*http.Cookie)
+	for _, c := range rr.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	if len(cookies) != 2 {
+		t.Fatalf("expected 2 distinct cookies but got %v", cookies)
+	}
+	if c := cookies["_session_flash"]; c.MaxAge != 0 || !c.Expires.IsZero() {
+		t.Fatalf("expected flash cookie to have no expiry but got %s", c)
+	}
+
+	// Read the session back from both cookies, and clear the flashes.
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies["_session"])
+	req.AddCookie(cookies["_session_flash"])
+
+	rr = httptest.NewRecorder()
+	if v := s.Flashes(rr, req)["notice"]; v != "Hello" {
+		t.Fatalf("expected Hello but got %v", v)
+	}
+	if v := s.Get(req, "key"); v != "value" {
+		t.Fatalf("expected value but got %v", v)
+	}
+
+	// Only the flash cookie is rewritten, and since there are no flashes left
+	// it is deleted.
+	written := rr.Result().Cookies()
+	if len(written) != 1 {
+		t.Fatalf("expected 1 cookie but got %d", len(written))
+	}
+	if c := written[0]; c.Name != "_session_flash" || c.MaxAge != -1 {
+		t.Fatalf("expected flash cookie to be deleted but got %s", c)
+	}
+
+	// The session cookie holds no flashes.
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies["_session"])
+	if flashes := s.Flashes(httptest.NewRecorder(), req); len(flashes) != 0 {
+		t.Fatalf("expected no flashes in the session cookie but got %v", flashes)
+	}
+}
+
+func TestSessionSeparateFlashCookieReset(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32), Options{SeparateFlashCookie: true})
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.Set(rr, req, "key", "value")
+	s.Flash(rr, req, "notice", "Hello")
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range rr.Result().Cookies() {
+		req.AddCookie(c)
+	}
+
+	rr = httptest.NewRecorder()
+	s.Reset(rr, req)
+
+	// The flash cookie is deleted along with the rest of the session.
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range rr.Result().Cookies() {
+		if c.MaxAge >= 0 {
+			req.AddCookie(c)
+		}
+	}
+	if flashes := s.Flashes(httptest.NewRecorder(), req); len(flashes) != 0 {
+		t.Fatalf("expected no flashes after reset but got %v", flashes)
+	}
+	if !slices.ContainsFunc(rr.Result().Cookies(), func(c *http.Cookie) bool {
+		return c.Name == "_session_flash" && c.MaxAge == -1
+	}) {
+		t.Fatalf("expected the flash cookie to be deleted but got %v", rr.Result().Cookies())
+	}
+}
+
+func TestSessionVerify(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.Set(rr, req, "key", "value")
+	valid := rr.Result().Cookies()[0]
+
+	rr = httptest.NewRecorder()
+	New(GenerateRandomKey(32)).Set(rr, httptest.NewRequest(http.MethodGet, "/", nil), "key", "value")
+	tampered := rr.Result().Cookies()[0]
+
+	cases := []struct {
+		name     string
+		cookie   *http.Cookie
+		expected bool
+	}{
+		{name: "valid cookie", cookie: valid, expected: true},
+		{name: "tampered cookie", cookie: tampered, expected: false},
+		{name: "no cookie", cookie: nil, expected: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if c.cookie != nil {
+				req.AddCookie(c.cookie)
+			}
+			if v := s.Verify(req); v != c.expected {
+				t.Fatalf("expected %t but got %t", c.expected, v)
+			}
+		})
+	}
+}
+
+func TestSessionMaxLength(t *testing.T) {
+	t.Parallel()
+
+	secret := GenerateRandomKey(32)
+	value := strings.Repeat("a", 4096)
+
+	t.Run("the default max length rejects a long session", func(t *testing.T) {
+		s := New(secret, Options{Quiet: true})
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		s.Set(rr, req, "key", value)
+
+		if h := rr.Result().Header.Get("Set-Cookie"); h != "" {
+			t.Fatalf("expected no Set-Cookie header but got %s", h)
+		}
+	})
+
+	t.Run("a larger max length round-trips a long session", func(t *testing.T) {
+		s := New(secret, Options{MaxLength: 8192})
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		s.Set(rr, req, "key", value)
+
+		req = httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(rr.Result().Cookies()[0])
+
+		if v := s.Get(req, "key"); v != value {
+			t.Fatalf("expected long value to round-trip but got %d bytes", len(fmt.Sprint(v)))
+		}
+	})
+}
+
+func TestSessionExportImport(t *testing.T) {
+	t.Parallel()
+
+	secret := GenerateRandomKey(32)
+	a := New(secret)
+	b := New(secret)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	a.Set(httptest.NewRecorder(), req, "user_id", "1")
+
+	token, err := a.Export(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("import a valid token", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		if err := b.Import(rr, req, token); err != nil {
+			t.Fatalf("expected no error but got %v", err)
+		}
+		if v := b.Get(req, "user_id"); v != "1" {
+			t.Fatalf("expected 1 but got %v", v)
+		}
+		if rr.Result().Header.Get("Set-Cookie") == "" {
+			t.Fatal("expected Set-Cookie header but got empty string")
+		}
+	})
+
+	t.Run("reject a tampered token", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		tampered, err := New(GenerateRandomKey(32)).Export(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Import(rr, req, tampered); !errors.Is(err, ErrTampered) {
+			t.Fatalf("expected ErrTampered but got %v", err)
+		}
+		if rr.Result().Header.Get("Set-Cookie") != "" {
+			t.Fatal("expected no Set-Cookie header")
+		}
+	})
+}
+
+func TestSessionGetFromToken(t *testing.T) {
+	t.Parallel()
+
+	secret := GenerateRandomKey(32)
+	s := New(secret)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.Set(httptest.NewRecorder(), req, "user_id", "1")
+
+	token, err := s.Export(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := New(secret).GetFromToken(token, "user_id")
+	if err != nil {
+		t.Fatalf("expected no error but got %v", err)
+	}
+	if v != "1" {
+		t.Fatalf("expected 1 but got %v", v)
+	}
+
+	if v, err := s.GetFromToken(token, "missing"); err != nil || v != nil {
+		t.Fatalf("expected nil value and no error for a missing key but got %v, %v", v, err)
+	}
+
+	tampered := token[:len(token)-4] + "AAAA"
+	if _, err := s.GetFromToken(tampered, "user_id"); !errors.Is(err, ErrTampered) && !errors.Is(err, ErrMalformed) {
+		t.Fatalf("expected ErrTampered or ErrMalformed but got %v", err)
+	}
+	if _, err := New(GenerateRandomKey(32)).GetFromToken(token, "user_id"); !errors.Is(err, ErrTampered) {
+		t.Fatalf("expected ErrTampered but got %v", err)
+	}
+}
+
+func TestSessionCookieWriter(t *testing.T) {
+	t.Parallel()
+
+	var cookies []*http.Cookie
+	s := New(GenerateRandomKey(32), Options{
+		DeleteWhenEmpty: true,
+		CookieWriter: func(w http.ResponseWriter, c *http.Cookie) {
+			cookies = append(cookies, c)
+		},
+	})
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Set(rr, req, "key", "value")
+	s.Reset(rr, req)
+
+	if h := rr.Result().Header.Get("Set-Cookie"); h != "" {
+		t.Fatalf("expected no Set-Cookie header but got %s", h)
+	}
+	if len(cookies) != 2 {
+		t.Fatalf("expected 2 cookies to be written but got %d", len(cookies))
+	}
+	if c := cookies[0]; c.Name != "_session" || c.Value == "" {
+		t.Fatalf("expected session cookie but got %s", c)
+	}
+	if c := cookies[1]; c.Name != "_session" || c.MaxAge != -1 {
+		t.Fatalf("expected deletion cookie but got %s", c)
+	}
+}
+
+func TestSessionNamePrefix(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32), Options{
+		NamePrefix:          "staging-",
+		SeparateFlashCookie: true,
+	})
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.Set(rr, req, "key", "value")
+	s.Flash(rr, req, "flash", "message")
+
+	names := make(map[string]bool)
+	for _, cookie := range rr.Result().Cookies() {
+		names[cookie.Name] = true
+	}
+	if !names["staging-_session"] || !names["staging-_session_flash"] || len(names) != 2 {
+		t.Fatalf("expected prefixed cookie names but got %v", names)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, cookie := range rr.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	if v := s.Get(req, "key"); v != "value" {
+		t.Fatalf("expected value from the prefixed cookie but got %v", v)
+	}
+	if flashes := s.Flashes(httptest.NewRecorder(), req); flashes["flash"] != "message" {
+		t.Fatalf("expected flash from the prefixed cookie but got %v", flashes)
+	}
+
+	buf := &bytes.Buffer{}
+	New(GenerateRandomKey(32), Options{
+		NamePrefix: "staging env ",
+		Logger:     log.New(buf, "", 0),
+	})
+	if logs := buf.String(); !strings.HasPrefix(logs, `sessions: [ERROR] invalid cookie name "staging env _session"`) {
+		t.Fatalf("expected invalid name error to be logged but got %q", logs)
+	}
+}
+
+func TestSessionDomain(t *testing.T) {
+	t.Parallel()
+
+	for _, domain := range []string{"example.com", ".example.com", "Example.com"} {
+		buf := &bytes.Buffer{}
+		s := New(GenerateRandomKey(32), Options{
+			Domain: domain,
+			Logger: log.New(buf, "", 0),
+		})
+
+		rr := httptest.NewRecorder()
+		s.Set(rr, httptest.NewRequest(http.MethodGet, "https://www.example.com:8443/", nil), "key", "value")
+
+		if h := rr.Header().Get("Set-Cookie"); !strings.Contains(h, "; Domain=example.com;") {
+			t.Fatalf("expected normalized domain for %s but got %s", domain, h)
+		}
+		if logs := buf.String(); logs != "" {
+			t.Fatalf("expected no warning for %s but got %q", domain, logs)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	s := New(GenerateRandomKey(32), Options{
+		Domain: "example.com",
+		Logger: log.New(buf, "", 0),
+	})
+
+	rr := httptest.NewRecorder()
+	s.Set(rr, httptest.NewRequest(http.MethodGet, "https://example.org/", nil), "key", "value")
+
+	if logs := buf.String(); !strings.HasPrefix(logs, "sessions: [WARNING] the cookie domain example.com does not match the request host example.org") {
+		t.Fatalf("expected mismatched host warning but got %q", logs)
+	}
+}
+
+func TestSessionEncodeBuffer(t *testing.T) {
+	t.Parallel()
+
+	// Use maps with a single key, since the order that map keys are encoded
+	// in isn't deterministic.
+	ss := &session{
+		Data:    map[string]interface{}{"key": "value"},
+		Flashes: map[string]interface{}{"notice": "saved"},
+		Tokens:  []string{"token"},
+	}
+
+	cs := &cborSerializer{}
+	want, err := cs.Serialize(ss)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Serialize into a buffer that already holds a previous value, as a
+	// buffer from the pool would.
+	eb := &encodeBuffer{v: ss}
+	eb.b.WriteString("previous value")
+	eb.b.Reset()
+	got, err := cs.Serialize(eb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != string(want) {
+		t.Fatalf("expected pooled encoding %x but got %x", want, got)
+	}
+}
+
+func TestSessionSizeByKey(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Set(rr, req, "small", "value")
+	s.Set(rr, req, "large", strings.Repeat("value", 100))
+	s.Flash(rr, req, "flash", "ignored")
+
+	cookies := rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+
+	sizes := s.SizeByKey(req)
+	if len(sizes) != 2 {
+		t.Fatalf("expected sizes for 2 keys but got %v", sizes)
+	}
+	if sizes["small"] == 0 || sizes["large"] <= sizes["small"] {
+		t.Fatalf("expected large value to be larger than small value but got %v", sizes)
+	}
+	if sizes["large"] < 500 {
+		t.Fatalf("expected large value to be at least 500 bytes but got %d", sizes["large"])
+	}
+}
+
+func TestSessionEphemeral(t *testing.T) {
+	t.Parallel()
+
+	key := GenerateRandomKey(32)
+	s := New(key, Options{Ephemeral: true})
+
+	h := s.TemplMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Set(w, r, "key", "value")
+		s.Flash(w, r, "flash", "message")
+		s.Delete(w, r, "other")
+
+		if v := s.Get(r, "key"); v != "value" {
+			t.Errorf("expected value within the request but got %v", v)
+		}
+		if flashes := s.FlashesCtx(r.Context()); flashes["flash"] != "message" {
+			t.Errorf("expected flash within the request but got %v", flashes)
+		}
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if h := rr.Header().Get("Set-Cookie"); h != "" {
+		t.Fatalf("expected no Set-Cookie header under the middleware but got %s", h)
+	}
+
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.Set(rr, req, "key", "value")
+	if v := s.Get(req, "key"); v != "value" {
+		t.Fatalf("expected value within the request but got %v", v)
+	}
+	if h := rr.Header().Get("Set-Cookie"); h != "" {
+		t.Fatalf("expected no Set-Cookie header but got %s", h)
+	}
+
+	// Cookies with the session's name are ignored.
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	New(key).Set(rr, req, "key", "value")
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(rr.Result().Cookies()[0])
+	if v := s.Get(req, "key"); v != nil {
+		t.Fatalf("expected cookie to be ignored but got %v", v)
+	}
+}
+
+func TestSessionCommit(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	s := New(GenerateRandomKey(32), Options{Logger: log.New(buf, "", 0)})
+
+	h := s.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Set(w, r, "key", "value")
+		if err := s.Commit(w, r); err != nil {
+			t.Errorf("expected no error but got %v", err)
+		}
+
+		io.Copy(w, strings.NewReader("streamed body"))
+		s.Set(w, r, "other", "value")
+
+		if err := s.Commit(w, r); !errors.Is(err, ErrResponseWritten) {
+			t.Errorf("expected ErrResponseWritten but got %v", err)
+		}
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	// The recorder's result has the headers as they were when the body was
+	// first written.
+	cookies := rr.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("expected the cookie to be set before the body")
+	}
+	if body := rr.Body.String(); body != "streamed body" {
+		t.Fatalf("expected streamed body but got %q", body)
+	}
+	if logs := buf.String(); !strings.HasPrefix(logs, "sessions: [WARNING] session was modified after it was committed") {
+		t.Fatalf("expected warning to be logged but got %q", logs)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+	if v := s.Get(req, "key"); v != "value" {
+		t.Fatalf("expected committed value but got %v", v)
+	}
+}
+
+func TestSessionCommitReset(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	s := New(GenerateRandomKey(32), Options{Logger: log.New(buf, "", 0)})
+
+	var cookies int
+	h := s.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Set(w, r, "key", "value")
+		if err := s.Commit(w, r); err != nil {
+			t.Errorf("expected no error but got %v", err)
+		}
+		cookies = len(w.Header()["Set-Cookie"])
+
+		s.Reset(w, r)
+		s.Login(w, r, "alice")
+		s.Logout(w, r)
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if got := len(rr.Header()["Set-Cookie"]); got != cookies {
+		t.Fatalf("expected %d cookies to be set but got %d", cookies, got)
+	}
+	if logs := buf.String(); !strings.HasPrefix(logs, "sessions: [WARNING] session was modified after it was committed") {
+		t.Fatalf("expected warning to be logged but got %q", logs)
+	}
+}
+
+func TestSessionFlashKeys(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	if keys := s.FlashKeys(req); len(keys) != 0 {
+		t.Fatalf("expected no flash keys but got %v", keys)
+	}
+
+	s.Flash(rr, req, "notice", "saved")
+	s.Flash(rr, req, "alert", "failed")
+
+	cookies := rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+
+	if keys := s.FlashKeys(req); !reflect.DeepEqual(keys, []string{"alert", "notice"}) {
+		t.Fatalf("expected flash keys [alert notice] but got %v", keys)
+	}
+	if flashes := s.Flashes(httptest.NewRecorder(), req); len(flashes) != 2 {
+		t.Fatalf("expected flashes to remain but got %v", flashes)
+	}
+}
+
+func TestSessionVersionUpgrade(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+
+	// The layout of the session before the version was recorded.
+	type sessionV1 struct {
+		Data            map[string]interface{}
+		Flashes         map[string]interface{}
+		RedirectFlashes []string
+		Tokens          []string
+		Expires         time.Time
+	}
+
+	v1, err := s.encode(s.name, &sessionV1{
+		Data:    map[string]interface{}{"key": "value"},
+		Flashes: map[string]interface{}{"notice": "saved"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ss, err := s.decodeValue(s.name, v1)
+	if err != nil {
+		t.Fatalf("expected v1 session to decode but got %v", err)
+	}
+	if ss.Version != sessionVersion {
+		t.Fatalf("expected session to be upgraded to version %d but got %d", sessionVersion, ss.Version)
+	}
+	if ss.Data["key"] != "value" || ss.Flashes["notice"] != "saved" {
+		t.Fatalf("expected v1 data and flashes but got %v and %v", ss.Data, ss.Flashes)
+	}
+
+	// Saving the session records the current version.
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: s.name, Value: v1})
+	s.Set(rr, req, "other", "value")
+
+	var saved struct{ Version int }
+	if err := s.decodeCookie(s.name, rr.Result().Cookies()[0].Value, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Version != sessionVersion {
+		t.Fatalf("expected saved session to have version %d but got %d", sessionVersion, saved.Version)
+	}
+}
+
+func TestSessionHashFunc(t *testing.T) {
+	t.Parallel()
+
+	secret := GenerateRandomKey(32)
+	s := New(secret, Options{HashFunc: sha512.New})
+
+	rr := httptest.NewRecorder()
+	s.Set(rr, httptest.NewRequest(http.MethodGet, "/", nil), "key", "value")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(rr.Result().Cookies()[0])
+
+	if v := s.Get(req, "key"); v != "value" {
+		t.Fatalf("expected value but got %v", v)
+	}
+
+	other := New(secret, Options{HashFunc: sha256.New, Quiet: true})
+	if v := other.Get(req, "key"); v != nil {
+		t.Fatalf("expected cookie signed with a different hash func to be rejected but got %v", v)
+	}
+	if err := other.Err(req); !errors.Is(err, ErrTampered) {
+		t.Fatalf("expected ErrTampered but got %v", err)
+	}
+}
+
+func TestSessionFlashAll(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	values := map[string]interface{}{
+		"notice": "saved",
+		"alert":  "failed",
+		"info":   "hello",
+	}
+	s.FlashAll(rr, req, values)
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie but got %d", len(cookies))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[0])
+	if flashes := s.Flashes(httptest.NewRecorder(), req); !reflect.DeepEqual(flashes, values) {
+		t.Fatalf("expected %v but got %v", values, flashes)
+	}
+
+	// An invalid key sets none of the flashes.
+	rr = httptest.NewRecorder()
+	s = New(GenerateRandomKey(32), Options{Quiet: true})
+	s.FlashAll(rr, httptest.NewRequest(http.MethodGet, "/", nil), map[string]interface{}{
+		"notice": "saved",
+		"":       "invalid",
+	})
+	if h := rr.Header().Get("Set-Cookie"); h != "" {
+		t.Fatalf("expected no Set-Cookie header but got %s", h)
+	}
+}
+
+func TestSessionFlashWith(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	meta := map[string]string{"icon": "check", "timeout": "5s"}
+	s.FlashWith(rr, req, "notice", "saved", meta)
+	s.Flash(rr, req, "alert", "plain")
+
+	cookies := rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+
+	rr = httptest.NewRecorder()
+	expected := map[string]FlashMessage{
+		"notice": {Value: "saved", Meta: meta},
+		"alert":  {Value: "plain"},
+	}
+	if messages := s.FlashMessages(rr, req); !reflect.DeepEqual(messages, expected) {
+		t.Fatalf("expected %v but got %v", expected, messages)
+	}
+
+	cookies = rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+	if messages := s.FlashMessages(httptest.NewRecorder(), req); len(messages) != 0 {
+		t.Fatalf("expected flash messages to be cleared but got %v", messages)
+	}
+}
+
+func TestSessionAfterSave(t *testing.T) {
+	t.Parallel()
+
+	var calls []map[string]interface{}
+	s := New(GenerateRandomKey(32), Options{
+		Quiet:     true,
+		MaxLength: 512,
+		AfterSave: func(r *http.Request, data map[string]interface{}) {
+			calls = append(calls, maps.Clone(data))
+		},
+	})
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.Set(rr, req, "a", "1")
+	s.Set(rr, req, "b", "2")
+
+	expected := []map[string]interface{}{
+		{"a": "1"},
+		{"a": "1", "b": "2"},
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected %v but got %v", expected, calls)
+	}
+
+	// The hook doesn't run when the session fails to encode.
+	calls = nil
+	s.Set(rr, req, "c", strings.Repeat("x", 1024))
+	if len(calls) != 0 {
+		t.Fatalf("expected no calls but got %v", calls)
+	}
+
+	// Under the Middleware, the hook runs once when the cookie is set.
+	calls = nil
+	h := s.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Set(w, r, "a", "1")
+		s.Set(w, r, "b", "2")
+		w.WriteHeader(http.StatusOK)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if !reflect.DeepEqual(calls, expected[1:]) {
+		t.Fatalf("expected %v but got %v", expected[1:], calls)
+	}
+
+	calls = nil
+	h = s.TemplMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Set(w, r, "a", "1")
+		s.Set(w, r, "b", "2")
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if !reflect.DeepEqual(calls, expected[1:]) {
+		t.Fatalf("expected %v but got %v", expected[1:], calls)
+	}
+}
+
+func TestSessionRotateValue(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32), Options{RotateValue: true})
+
+	var values []string
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		s.Set(rr, httptest.NewRequest(http.MethodGet, "/", nil), "key", "value")
+		cookie := rr.Result().Cookies()[0]
+		values = append(values, cookie.Value)
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(cookie)
+		if v := s.Get(req, "key"); v != "value" {
+			t.Fatalf("expected value but got %v", v)
+		}
+	}
+
+	if values[0] == values[1] {
+		t.Fatalf("expected different cookie values but got %s twice", values[0])
+	}
+}
+
+func TestSessionSkipSave(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32), Options{
+		SkipSave: func(r *http.Request) bool {
+			return strings.Contains(r.UserAgent(), "Googlebot")
+		},
+	})
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		s.Set(w, r, "key", "value")
+		if v := s.Get(r, "key"); v != "value" {
+			t.Errorf("expected value but got %v", v)
+		}
+	}
+
+	for name, h := range map[string]http.Handler{
+		"direct":          http.HandlerFunc(handler),
+		"Middleware":      s.Middleware(http.HandlerFunc(handler)),
+		"TemplMiddleware": s.TemplMiddleware(http.HandlerFunc(handler)),
+	} {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; Googlebot/2.1)")
+		h.ServeHTTP(rr, req)
+		if c := rr.Header().Get("Set-Cookie"); c != "" {
+			t.Fatalf("%s: expected no Set-Cookie header but got %s", name, c)
+		}
+
+		rr = httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+		if c := rr.Header().Get("Set-Cookie"); c == "" {
+			t.Fatalf("%s: expected a Set-Cookie header", name)
+		}
+	}
+}
+
+func TestSessionHashKeys(t *testing.T) {
+	t.Parallel()
+
+	// payload returns the serialized session from the given cookie.
+	payload := func(t *testing.T, c *http.Cookie) []byte {
+		b, err := base64.URLEncoding.DecodeString(c.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts := bytes.SplitN(b, []byte("|"), 3)
+		v, err := base64.URLEncoding.DecodeString(string(parts[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	secret := GenerateRandomKey(32)
+	for _, hashKeys := range []bool{false, true} {
+		s := New(secret, Options{HashKeys: hashKeys})
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		s.Set(rr, req, "is_admin", true)
+		s.Set(rr, req, "user_id", "42")
+
+		cookies := rr.Result().Cookies()
+		cookie := cookies[len(cookies)-1]
+		req = httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(cookie)
+
+		if v := s.Get(req, "is_admin"); v != true {
+			t.Fatalf("expected true but got %v", v)
+		}
+		if v := s.Get(req, "user_id"); v != "42" {
+			t.Fatalf("expected 42 but got %v", v)
+		}
+		if !s.Has(req, "user_id") {
+			t.Fatal("expected session to have user_id")
+		}
+
+		b := payload(t, cookie)
+		for _, key := range []string{"is_admin", "user_id"} {
+			if contains := bytes.Contains(b, []byte(key)); contains == hashKeys {
+				t.Fatalf("expected payload to contain %s to be %t but got %t", key, !hashKeys, contains)
+			}
+		}
+	}
+
+	// The hashed keys depend on the secret.
+	k1 := New(secret, Options{HashKeys: true}).dataKey("key")
+	k2 := New(GenerateRandomKey(32), Options{HashKeys: true}).dataKey("key")
+	if k1 == k2 {
+		t.Fatalf("expected different hashed keys but got %s for both", k1)
+	}
+}
+
+func TestSessionHashKeysPrefix(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	s := New(GenerateRandomKey(32), Options{HashKeys: true, Logger: log.New(buf, "", 0)})
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.Set(rr, req, "cart:items", "3")
+
+	if values := s.WithPrefix(req, "cart:"); len(values) != 0 {
+		t.Fatalf("expected no values but got %v", values)
+	}
+	s.DeletePrefix(rr, req, "cart:")
+	if n := s.DeleteFunc(rr, req, func(string, interface{}) bool { return true }); n != 0 {
+		t.Fatalf("expected no values to be deleted but got %d", n)
+	}
+	if v := s.Get(req, "cart:items"); v != "3" {
+		t.Fatalf("expected 3 but got %v", v)
+	}
+
+	// Each method logs an error rather than silently matching nothing.
+	for _, method := range []string{"WithPrefix", "DeletePrefix", "DeleteFunc"} {
+		if !strings.Contains(buf.String(), "[ERROR] "+method+" can't be used with the HashKeys option") {
+			t.Fatalf("expected an error to be logged for %s but got %q", method, buf)
+		}
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	t.Parallel()
+
+	valid := Options{
+		Name:                "__Host-session",
+		FallbackNames:       []string{"_session"},
+		MaxAge:              -1,
+		MaxLength:           -1,
+		MaxKeys:             10,
+		SeparateFlashCookie: true,
+		KeyRefreshInterval:  time.Hour,
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("expected no error but got %v", err)
+	}
+
+	tests := map[string]struct {
+		opts     Options
+		expected string
+	}{
+		"invalid name":          {Options{Name: "my session"}, `invalid cookie name "my session"`},
+		"invalid prefixed name": {Options{NamePrefix: "a b"}, `invalid cookie name "a b_session"`},
+		"duplicate name":        {Options{FallbackNames: []string{"_session"}}, `the cookie name "_session" is used more than once`},
+		"flash name":            {Options{SeparateFlashCookie: true, FallbackNames: []string{"_session_flash"}}, `the flash cookie name "_session_flash" is also one of the FallbackNames`},
+		"host prefix":           {Options{Name: "__Host-session", Domain: "example.com"}, `the cookie name "__Host-session" begins with the __Host- prefix, so the Domain option can't be set`},
+		"max age":               {Options{MaxAge: -2}, "MaxAge is -2, but must be -1 or greater"},
+		"max length":            {Options{MaxLength: -2}, "MaxLength is -2, but must be -1 or greater"},
+		"max buffer reuse size": {Options{MaxBufferReuseSize: -2}, "MaxBufferReuseSize is -2, but must be -1 or greater"},
+		"header only":           {Options{HeaderOnly: true}, "HeaderOnly is set, but ResponseHeader isn't, so the session would never be sent"},
+		"bind tolerance":        {Options{BindTolerance: -1}, "BindTolerance is -1, but must not be negative"},
+		"refresh after":         {Options{RefreshAfter: -1}, "RefreshAfter is -1, but must not be negative"},
+		"max key length":        {Options{MaxKeyLength: -1}, "MaxKeyLength is -1, but must not be negative"},
+		"max keys":              {Options{MaxKeys: -1}, "MaxKeys is -1, but must not be negative"},
+		"key refresh interval":  {Options{KeyRefreshInterval: -time.Second}, "KeyRefreshInterval is -1s, but must not be negative"},
+	}
+	for name, tt := range tests {
+		err := tt.opts.Validate()
+		if !errors.Is(err, ErrInvalidOptions) {
+			t.Fatalf("%s: expected ErrInvalidOptions but got %v", name, err)
+		}
+		if !strings.Contains(err.Error(), tt.expected) {
+			t.Fatalf("%s: expected error to contain %q but got %q", name, tt.expected, err)
+		}
+	}
+
+	// Every problem is described.
+	err := Options{MaxAge: -2, MaxKeys: -1}.Validate()
+	if expected := "sessions: invalid options: MaxAge is -2, but must be -1 or greater; MaxKeys is -1, but must not be negative"; err == nil || err.Error() != expected {
+		t.Fatalf("expected %q but got %v", expected, err)
+	}
+
+	s, err := NewWithError(GenerateRandomKey(32), Options{MaxAge: -2})
+	if s != nil || !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected ErrInvalidOptions but got %v, %v", s, err)
+	}
+	if s, err := NewWithError(GenerateRandomKey(32), valid); s == nil || err != nil {
+		t.Fatalf("expected a session manager but got %v, %v", s, err)
+	}
+}
+
+func TestSessionHealthCheck(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	if err := s.HealthCheck(context.Background()); err != nil {
+		t.Fatalf("expected no error but got %v", err)
+	}
+
+	s = New(nil, Options{Quiet: true})
+	if err := s.HealthCheck(context.Background()); err == nil {
+		t.Fatal("expected an error for a session manager without a key")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := New(GenerateRandomKey(32)).HealthCheck(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled but got %v", err)
+	}
+}
+
+func TestSessionTimestamps(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if _, _, ok := s.Timestamps(req); ok {
+		t.Fatal("expected no timestamps for a new session")
+	}
+
+	s.Set(rr, req, "key", "value")
+	created, updated, ok := s.Timestamps(req)
+	if !ok || created.IsZero() || !created.Equal(updated) {
+		t.Fatalf("expected equal timestamps but got %s and %s", created, updated)
+	}
+
+	time.Sleep(time.Millisecond)
+	s.Set(rr, req, "key", "other")
+	created2, updated2, _ := s.Timestamps(req)
+	if !created2.Equal(created) {
+		t.Fatalf("expected created at to be %s but got %s", created, created2)
+	}
+	if !updated2.After(updated) {
+		t.Fatalf("expected updated at to advance past %s but got %s", updated, updated2)
+	}
+
+	// The timestamps are stored in the cookie.
+	cookies := rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+	created3, updated3, ok := s.Timestamps(req)
+	if !ok || !created3.Equal(created.Truncate(time.Second)) || !updated3.Equal(updated2.Truncate(time.Second)) {
+		t.Fatalf("expected decoded timestamps %s and %s but got %s and %s", created, updated2, created3, updated3)
+	}
+
+	s.Set(httptest.NewRecorder(), req, "key", "value")
+	if created4, _, _ := s.Timestamps(req); !created4.Equal(created3) {
+		t.Fatalf("expected created at to be %s but got %s", created3, created4)
+	}
+}
+
+func TestSessionDrainFlashes(t *testing.T) {
+	t.Parallel()
+
+	for _, separate := range []bool{false, true} {
+		s := New(GenerateRandomKey(32), Options{SeparateFlashCookie: separate})
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		s.Flash(rr, req, "warning", "careful")
+		s.Flash(rr, req, "notice", "saved")
+		s.Flash(rr, req, "alert", "failed")
+
+		// Send only the last cookie set with each name.
+		latest := make(map[string]*http.Cookie)
+		for _, cookie := range rr.Result().Cookies() {
+			latest[cookie.Name] = cookie
+		}
+		req = httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, cookie := range latest {
+			req.AddCookie(cookie)
+		}
+
+		rr = httptest.NewRecorder()
+		entries, values := s.DrainFlashes(rr, req)
+		expected := []FlashEntry{
+			{Key: "warning", Value: "careful", Index: 0},
+			{Key: "notice", Value: "saved", Index: 1},
+			{Key: "alert", Value: "failed", Index: 2},
+		}
+		if !reflect.DeepEqual(entries, expected) {
+			t.Fatalf("expected %v but got %v", expected, entries)
+		}
+		if len(values) != len(entries) {
+			t.Fatalf("expected %d values but got %v", len(entries), values)
+		}
+		for _, entry := range entries {
+			if values[entry.Key] != entry.Value {
+				t.Fatalf("expected %v for %s but got %v", entry.Value, entry.Key, values[entry.Key])
+			}
+		}
+
+		req = httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, cookie := range rr.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		if entries, values := s.DrainFlashes(httptest.NewRecorder(), req); len(entries) != 0 || len(values) != 0 {
+			t.Fatalf("expected flashes to be cleared but got %v and %v", entries, values)
+		}
+	}
+}
+
+func TestSessionDeleteFunc(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.Set(rr, req, "cart.item1", 1)
+	s.Set(rr, req, "cart.item2", 2)
+	s.Set(rr, req, "user", "ben")
+
+	cookies := rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+
+	rr = httptest.NewRecorder()
+	n := s.DeleteFunc(rr, req, func(key string, value interface{}) bool {
+		return strings.HasPrefix(key, "cart.")
+	})
+	if n != 2 {
+		t.Fatalf("expected 2 values to be deleted but got %d", n)
+	}
+	if cookies := rr.Result().Cookies(); len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie but got %d", len(cookies))
+	}
+	if expected, list := map[string]interface{}{"user": "ben"}, s.List(req); !reflect.DeepEqual(list, expected) {
+		t.Fatalf("expected %v but got %v", expected, list)
+	}
+
+	// Nothing is saved when no values are deleted.
+	rr = httptest.NewRecorder()
+	if n := s.DeleteFunc(rr, req, func(string, interface{}) bool { return false }); n != 0 {
+		t.Fatalf("expected no values to be deleted but got %d", n)
+	}
+	if h := rr.Header().Get("Set-Cookie"); h != "" {
+		t.Fatalf("expected no Set-Cookie header but got %s", h)
+	}
+}
+
+func TestSessionTrySetAll(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32), Options{MaxLength: 512})
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	ok, size, err := s.TrySetAll(rr, req, map[string]interface{}{"a": "1", "b": "2"})
+	if !ok || err != nil {
+		t.Fatalf("expected values to be set but got %t, %v", ok, err)
+	}
+	cookie := rr.Result().Cookies()[0]
+	if size != len(cookie.Value) {
+		t.Fatalf("expected size %d but got %d", len(cookie.Value), size)
+	}
+	if v := s.Get(req, "b"); v != "2" {
+		t.Fatalf("expected 2 but got %v", v)
+	}
+
+	// Values that don't fit aren't set.
+	rr = httptest.NewRecorder()
+	ok, size, err = s.TrySetAll(rr, req, map[string]interface{}{"c": strings.Repeat("x", 512)})
+	if ok || err != nil {
+		t.Fatalf("expected values not to fit but got %t, %v", ok, err)
+	}
+	if size <= 512 {
+		t.Fatalf("expected size over 512 but got %d", size)
+	}
+	if h := rr.Header().Get("Set-Cookie"); h != "" {
+		t.Fatalf("expected no Set-Cookie header but got %s", h)
+	}
+	if s.Has(req, "c") {
+		t.Fatal("expected c not to be set")
+	}
+
+	if _, _, err := s.TrySetAll(rr, req, map[string]interface{}{"": "invalid"}); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("expected ErrInvalidKey but got %v", err)
+	}
+}
+
+func TestSessionGeneration(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	s := New(GenerateRandomKey(32), Options{
+		WarnStaleGeneration: true,
+		Logger:              log.New(buf, "", 0),
+	})
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if gen := s.Generation(req); gen != 0 {
+		t.Fatalf("expected generation 0 but got %d", gen)
+	}
+
+	s.Set(rr, req, "key", "value")
+	token, err := s.Export(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i <= 3; i++ {
+		s.Set(rr, req, "key", i)
+		if gen := s.Generation(req); gen != i {
+			t.Fatalf("expected generation %d but got %d", i, gen)
+		}
+	}
+
+	// The generation is stored in the cookie.
+	cookies := rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+	if gen := s.Generation(req); gen != 3 {
+		t.Fatalf("expected generation 3 but got %d", gen)
+	}
+
+	// Importing an older copy of the session logs a warning.
+	if err := s.Import(httptest.NewRecorder(), req, token); err != nil {
+		t.Fatal(err)
+	}
+	if logs := buf.String(); !strings.HasPrefix(logs, "sessions: [WARNING] replaced session of generation 3 with a stale session of generation 1") {
+		t.Fatalf("expected stale generation warning but got %q", logs)
+	}
+}
+
+func TestSessionFromQueryParam(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.Set(httptest.NewRecorder(), req, "user", "ben")
+	s.SetExpiry(httptest.NewRecorder(), req, time.Now().Add(15*time.Minute))
+	token, err := s.Export(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/login?token="+url.QueryEscape(token), nil)
+	if err := s.FromQueryParam(rr, req, "token"); err != nil {
+		t.Fatalf("expected no error but got %v", err)
+	}
+	if v := s.Get(req, "user"); v != "ben" {
+		t.Fatalf("expected ben but got %v", v)
+	}
+
+	cookies := rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+	if v := s.Get(req, "user"); v != "ben" {
+		t.Fatalf("expected ben from the cookie but got %v", v)
+	}
+
+	// Tampered and missing tokens are rejected.
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/login?token="+url.QueryEscape(token[:len(token)-4]+"AAAA"), nil)
+	if err := s.FromQueryParam(rr, req, "token"); !errors.Is(err, ErrTampered) {
+		t.Fatalf("expected ErrTampered but got %v", err)
+	}
+	if h := rr.Header().Get("Set-Cookie"); h != "" {
+		t.Fatalf("expected no Set-Cookie header but got %s", h)
+	}
+	if err := s.FromQueryParam(rr, httptest.NewRequest(http.MethodGet, "/login", nil), "token"); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("expected ErrMalformed but got %v", err)
+	}
+}
+
+func TestSessionDecodeMaxAge(t *testing.T) {
+	t.Parallel()
+
+	secret := GenerateRandomKey(32)
+	s := New(secret, Options{Quiet: true, DecodeMaxAge: 60})
+
+	// The cookie is kept by the browser for the default max age.
+	rr := httptest.NewRecorder()
+	s.Set(rr, httptest.NewRequest(http.MethodGet, "/", nil), "key", "value")
+	if cookie := rr.Result().Cookies()[0]; cookie.MaxAge != defaultMaxAge {
+		t.Fatalf("expected cookie max age %d but got %d", defaultMaxAge, cookie.MaxAge)
+	}
+
+	ss := &session{Data: map[string]interface{}{"key": "value"}}
+	for _, c := range []struct {
+		age      time.Duration
+		expected error
+	}{
+		{age: 30 * time.Second},
+		{age: 2 * time.Minute, expected: ErrExpired},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{
+			Name:    "_session",
+			Value:   encodeAt(t, secret, "_session", ss, time.Now().Add(-c.age)),
+			Expires: time.Now().Add(time.Hour),
+		})
+		if err := s.Err(req); !errors.Is(err, c.expected) {
+			t.Fatalf("expected %v for a cookie %s old but got %v", c.expected, c.age, err)
+		}
+	}
+
+	// The MaxAge option sets the cookie's max age.
+	rr = httptest.NewRecorder()
+	New(secret, Options{MaxAge: 3600}).Set(rr, httptest.NewRequest(http.MethodGet, "/", nil), "key", "value")
+	if cookie := rr.Result().Cookies()[0]; cookie.MaxAge != 3600 {
+		t.Fatalf("expected cookie max age 3600 but got %d", cookie.MaxAge)
+	}
+}
+
+func TestSessionID(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	// The ID of a new session stays the same once it's saved.
+	id := s.ID(req)
+	if id == "" {
+		t.Fatal("expected an ID")
+	}
+	s.Set(rr, req, "key", "value")
+	if got := s.ID(req); got != id {
+		t.Fatalf("expected ID %s but got %s", id, got)
+	}
+
+	for i := 0; i < 2; i++ {
+		cookies := rr.Result().Cookies()
+		req = httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(cookies[len(cookies)-1])
+		if got := s.ID(req); got != id {
+			t.Fatalf("expected ID %s but got %s", id, got)
+		}
+
+		rr = httptest.NewRecorder()
+		s.Set(rr, req, "key", i)
+	}
+
+	s.Regenerate(rr, req)
+	regenerated := s.ID(req)
+	if regenerated == id {
+		t.Fatalf("expected a new ID after regenerating but got %s", id)
+	}
+	if v := s.Get(req, "key"); v == nil {
+		t.Fatal("expected session data to be kept after regenerating")
+	}
+
+	cookies := rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+	if got := s.ID(req); got != regenerated {
+		t.Fatalf("expected ID %s but got %s", regenerated, got)
+	}
+}
+
+func TestSessionCompareAndSwap(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	// A key that isn't present can only be swapped from nil.
+	if s.CompareAndSwap(rr, req, "checkout", "pending", "done") {
+		t.Fatal("expected swap of an absent key from a non-nil value to fail")
+	}
+	if h := rr.Header().Get("Set-Cookie"); h != "" {
+		t.Fatalf("expected no Set-Cookie header but got %s", h)
+	}
+	if !s.CompareAndSwap(rr, req, "checkout", nil, 1) {
+		t.Fatal("expected swap of an absent key from nil to succeed")
+	}
+
+	// Values decoded from the cookie are compared by their encoding.
+	cookies := rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+
+	rr = httptest.NewRecorder()
+	if s.CompareAndSwap(rr, req, "checkout", 2, "done") {
+		t.Fatal("expected swap of a mismatched value to fail")
+	}
+	if h := rr.Header().Get("Set-Cookie"); h != "" {
+		t.Fatalf("expected no Set-Cookie header but got %s", h)
+	}
+	if !s.CompareAndSwap(rr, req, "checkout", 1, "done") {
+		t.Fatal("expected swap of a matching value to succeed")
+	}
+	if v := s.Get(req, "checkout"); v != "done" {
+		t.Fatalf("expected done but got %v", v)
+	}
+	if cookies := rr.Result().Cookies(); len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie but got %d", len(cookies))
+	}
+}
+
+func TestSessionFlashOrder(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		order    FlashOrder
+		expected []string
+	}{
+		{order: FlashFIFO, expected: []string{"first", "second", "third"}},
+		{order: FlashLIFO, expected: []string{"third", "second", "first"}},
+	} {
+		s := New(GenerateRandomKey(32), Options{FlashOrder: tt.order})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, key := range []string{"first", "second", "third"} {
+			s.Flash(httptest.NewRecorder(), req, key, key)
+		}
+
+		entries, _ := s.DrainFlashes(httptest.NewRecorder(), req)
+		keys := make([]string, len(entries))
+		for i, entry := range entries {
+			if entry.Index != i {
+				t.Fatalf("expected index %d but got %d", i, entry.Index)
+			}
+			keys[i] = entry.Key
+		}
+		if !reflect.DeepEqual(keys, tt.expected) {
+			t.Fatalf("expected %v but got %v", tt.expected, keys)
+		}
+	}
+}
+
+func TestSessionMaxValueSize(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32), Options{MaxValueSize: 64, Quiet: true})
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	if err := s.TrySet(rr, req, "small", strings.Repeat("x", 32)); err != nil {
+		t.Fatalf("expected no error but got %v", err)
+	}
+	if err := s.TrySet(rr, req, "large", strings.Repeat("x", 128)); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expected ErrValueTooLarge but got %v", err)
+	}
+	if s.Has(req, "large") {
+		t.Fatal("expected large value not to be set")
+	}
+
+	_, _, err := s.TrySetAll(rr, req, map[string]interface{}{
+		"other": "value",
+		"large": strings.Repeat("x", 128),
+	})
+	if !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expected ErrValueTooLarge but got %v", err)
+	}
+	if s.Has(req, "other") {
+		t.Fatal("expected none of the values to be set")
+	}
+
+	s.AppendToList(rr, req, "list", strings.Repeat("x", 128), 0)
+	if s.Has(req, "list") {
+		t.Fatal("expected large list value not to be appended")
+	}
+}
+
+func TestTemplMiddlewareMaxBufferReuseSize(t *testing.T) {
+	t.Parallel()
+
+	const maxReuse = 1024
+
+	s := New(GenerateRandomKey(32), Options{MaxBufferReuseSize: maxReuse})
+	var caps []int
+	h := s.TemplMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caps = append(caps, w.(*responseWrapper).b.Cap())
+		size := 16
+		if r.URL.Path == "/large" {
+			size = 64 * maxReuse
+		}
+		w.Write(bytes.Repeat([]byte("x"), size))
+	}))
+
+	for _, path := range []string{"/large", "/small", "/small", "/small", "/small"} {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	for i, c := range caps {
+		if c > maxReuse {
+			t.Fatalf("expected request %d to get a buffer with capacity of at most %d bytes but got %d", i, maxReuse, c)
+		}
+	}
+}
+
+func TestSessionFreeze(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	s := New(GenerateRandomKey(32), Options{Logger: log.New(buf, "", 0)})
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "_session_flash", Value: "stale"})
+	s.Set(rr, req, "user", "alice")
+	s.Flash(rr, req, "notice", "hello")
+	s.Namespace("cart").Set(rr, req, "item", "book")
+	s.Freeze(req)
+	cookies := len(rr.Header()["Set-Cookie"])
+
+	s.Set(rr, req, "user", "mallory")
+	s.Delete(rr, req, "user")
+	s.Flash(rr, req, "notice", "goodbye")
+	s.Namespace("cart").Set(rr, req, "item", "phone")
+	s.Reset(rr, req)
+	s.Login(rr, req, "mallory")
+	s.Logout(rr, req)
+
+	if got := s.Get(req, "user"); got != "alice" {
+		t.Fatalf("expected value alice but got %v", got)
+	}
+	if got := s.Namespace("cart").Get(req, "item"); got != "book" {
+		t.Fatalf("expected namespace value book but got %v", got)
+	}
+	if got := s.Flashes(rr, req)["notice"]; got != "hello" {
+		t.Fatalf("expected flash hello but got %v", got)
+	}
+	if got := s.UserID(req); got != "" {
+		t.Fatalf("expected no user to be logged in but got %q", got)
+	}
+	if got := len(rr.Header()["Set-Cookie"]); got != cookies {
+		t.Fatalf("expected %d cookies to be set but got %d", cookies, got)
+	}
+	if !strings.Contains(buf.String(), "[WARNING] session was modified after it was frozen") {
+		t.Fatalf("expected a warning to be logged but got %q", buf)
+	}
+}
+
+func TestSessionFreezeFlashesCtx(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	s.Flash(rr, httptest.NewRequest(http.MethodGet, "/", nil), "notice", "hello")
+	cookie := rr.Result().Cookies()[0]
+
+	for name, flashesCtx := range map[string]func(ctx context.Context) map[string]interface{}{
+		"method":  s.FlashesCtx,
+		"package": FlashesCtx,
+	} {
+		h := s.TemplMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.Freeze(r)
+			if v := flashesCtx(r.Context())["notice"]; v != "hello" {
+				t.Errorf("expected flash hello from the %s FlashesCtx but got %v", name, v)
+			}
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		// Reading the flashes of a frozen session doesn't clear them.
+		if cookies := rr.Result().Cookies(); len(cookies) != 0 {
+			t.Fatalf("expected no cookies from the %s FlashesCtx but got %v", name, cookies)
+		}
+	}
+}
+
+func TestSessionResponseHeader(t *testing.T) {
+	t.Parallel()
+
+	secret := GenerateRandomKey(32)
+
+	for _, headerOnly := range []bool{false, true} {
+		s := New(secret, Options{ResponseHeader: "X-Session-Token", HeaderOnly: headerOnly})
+
+		rr := httptest.NewRecorder()
+		s.Set(rr, httptest.NewRequest(http.MethodGet, "/", nil), "key", "value")
+
+		token := rr.Header().Get("X-Session-Token")
+		if token == "" {
+			t.Fatalf("expected the session token in the header with header only %t", headerOnly)
+		}
+
+		cookies := rr.Result().Cookies()
+		if headerOnly && len(cookies) != 0 {
+			t.Fatalf("expected no cookies with header only but got %d", len(cookies))
+		}
+		if !headerOnly && (len(cookies) != 1 || cookies[0].Value != token) {
+			t.Fatalf("expected a session cookie with the same value as the header but got %v", cookies)
+		}
+
+		rr = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		other := New(secret)
+		if err := other.Import(rr, req, token); err != nil {
+			t.Fatalf("expected the header's token to be decodable but got %v", err)
+		}
+		if got, _ := other.GetString(req, "key"); got != "value" {
+			t.Fatalf("expected value but got %q", got)
+		}
+	}
+}
+
+func TestSessionOmitExpires(t *testing.T) {
 	t.Parallel()
 
-	s := New(GenerateRandomKey(32))
-	rr := httptest.NewRecorder()
+	s := New(GenerateRandomKey(32), Options{OmitExpires: true, DeleteWhenEmpty: true})
+
+	// Set the cookie directly, under the TemplMiddleware, and by deleting it.
+	direct := httptest.NewRecorder()
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.Set(direct, req, "key", "value")
 
-	s.Set(rr, req, "key", "value")
-	v := s.Get(req, "key")
-	if v == nil {
-		t.Fatal("got nil")
+	templ := httptest.NewRecorder()
+	s.TemplMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Set(w, r, "key", "value")
+	})).ServeHTTP(templ, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	deleted := httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(direct.Result().Cookies()[0])
+	s.Delete(deleted, req, "key")
+
+	for name, rr := range map[string]*httptest.ResponseRecorder{"direct": direct, "templ": templ, "deleted": deleted} {
+		header := rr.Header().Get("Set-Cookie")
+		if !strings.Contains(header, "Max-Age=") {
+			t.Fatalf("expected Max-Age in the %s cookie but got %q", name, header)
+		}
+		if strings.Contains(header, "Expires=") {
+			t.Fatalf("expected no Expires in the %s cookie but got %q", name, header)
+		}
 	}
 
-	s.Reset(rr, req)
-	v = s.Get(req, "key")
-	if v != nil {
-		t.Fatalf("expected nil, got %v", v)
+	// Without the option, the Expires attribute is still set.
+	rr := httptest.NewRecorder()
+	New(GenerateRandomKey(32)).Set(rr, httptest.NewRequest(http.MethodGet, "/", nil), "key", "value")
+	if header := rr.Header().Get("Set-Cookie"); !strings.Contains(header, "Expires=") {
+		t.Fatalf("expected Expires in the cookie but got %q", header)
 	}
 }
 
-func TestSessionFlashes(t *testing.T) {
+func TestSessionReadCache(t *testing.T) {
 	t.Parallel()
 
 	s := New(GenerateRandomKey(32))
 	rr := httptest.NewRecorder()
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.Set(rr, req, "key", "value")
+	cookies := rr.Result().Cookies()
 
-	s.Flash(rr, req, "flash1", "value1")
-	s.Flash(rr, req, "flash2", "value2")
+	var reads []*http.Request
+	read := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if v := s.Get(r, "key"); v != "value" {
+				t.Errorf("expected value but got %v", v)
+			}
+			reads = append(reads, r)
+			next.ServeHTTP(w, r)
+		})
+	}
 
-	values1 := s.Flashes(rr, req)
-	values2 := s.Flashes(rr, req)
+	h := s.Middleware(read(read(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))))
 
-	if v := values1["flash1"].(string); v != "value1" {
-		t.Fatalf("expected value1, got %s", v)
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+	h.ServeHTTP(rr, req)
+
+	if h := rr.Header().Get("Set-Cookie"); h != "" {
+		t.Fatalf("expected no Set-Cookie header but got %s", h)
 	}
-	if v := values1["flash2"].(string); v != "value2" {
-		t.Fatalf("expected value2, got %s", v)
+
+	// The session decoded by the first read is reused by the second.
+	if first, second := s.fromReq(reads[0]), s.fromReq(reads[1]); first != second {
+		t.Fatal("expected the second read to reuse the session decoded by the first")
 	}
-	if len(values2) != 0 {
-		t.Fatalf("expected empty initialized session but got %v", values2)
+}
+
+func TestSessionConcurrentReads(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	s.Set(rr, httptest.NewRequest(http.MethodGet, "/", nil), "key", "value")
+
+	// Reading the session from many goroutines at once must be safe, with
+	// and without the middleware, which the race detector checks.
+	read := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if v := s.Get(r, "key"); v != "value" {
+					t.Errorf("expected value but got %v", v)
+				}
+			}()
+		}
+		wg.Wait()
+	})
+
+	for _, h := range []http.Handler{read, s.Middleware(read)} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(rr.Result().Cookies()[0])
+		h.ServeHTTP(httptest.NewRecorder(), req)
 	}
 }
 
@@ -287,6 +2836,98 @@ func TestSessionManagerIntegration(t *testing.T) {
 	}
 }
 
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+
+	h := s.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Set(w, r, "key", "value")
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("expected response writer to implement http.Flusher")
+		}
+		w.Write([]byte("Hello, world!"))
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rr.Result().Header.Get("Set-Cookie") == "" {
+		t.Fatal("expected Set-Cookie header but got empty string")
+	}
+	if body := rr.Body.String(); body != "Hello, world!" {
+		t.Fatalf("expected Hello, world! but got %s", body)
+	}
+}
+
+func TestMiddlewareDeferredCookie(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+
+	t.Run("eager writing handler", func(t *testing.T) {
+		h := s.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.Set(w, r, "a", "1")
+			s.Set(w, r, "b", "2")
+			s.Flash(w, r, "notice", "saved")
+			if h := w.Header().Get("Set-Cookie"); h != "" {
+				t.Errorf("expected cookie not to be set before writing but got %s", h)
+			}
+			w.WriteHeader(http.StatusCreated)
+		}))
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		cookies := rr.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("expected 1 cookie but got %d", len(cookies))
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(cookies[0])
+		if a, b := s.Get(req, "a"), s.Get(req, "b"); a != "1" || b != "2" {
+			t.Fatalf("expected both values but got %v and %v", a, b)
+		}
+		if flashes := s.Flashes(httptest.NewRecorder(), req); flashes["notice"] != "saved" {
+			t.Fatalf("expected flash but got %v", flashes)
+		}
+	})
+
+	t.Run("never writing handler", func(t *testing.T) {
+		h := s.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.Set(w, r, "key", "value")
+		}))
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		cookies := rr.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("expected 1 cookie but got %d", len(cookies))
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(cookies[0])
+		if v := s.Get(req, "key"); v != "value" {
+			t.Fatalf("expected value but got %v", v)
+		}
+	})
+
+	t.Run("read only handler", func(t *testing.T) {
+		h := s.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.Get(r, "key")
+		}))
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if h := rr.Header().Get("Set-Cookie"); h != "" {
+			t.Fatalf("expected no Set-Cookie header but got %s", h)
+		}
+	})
+}
+
 func TestTemplMiddleware(t *testing.T) {
 	t.Parallel()
 
@@ -382,6 +3023,198 @@ func TestTemplMiddleware(t *testing.T) {
 	}
 }
 
+// writeRecorder records whether the status code or body was ever written.
+type writeRecorder struct {
+	header  http.Header
+	written bool
+}
+
+func (wr *writeRecorder) Header() http.Header {
+	return wr.header
+}
+
+func (wr *writeRecorder) Write(data []byte) (int, error) {
+	wr.written = true
+	return len(data), nil
+}
+
+func (wr *writeRecorder) WriteHeader(statusCode int) {
+	wr.written = true
+}
+
+func TestTemplMiddlewareCanceled(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+
+	h := s.TemplMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello, world!"))
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	w := &writeRecorder{header: make(http.Header)}
+	req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	h.ServeHTTP(w, req)
+
+	if w.written {
+		t.Fatal("expected the response not to be flushed")
+	}
+	if h := w.Header().Get("Set-Cookie"); h != "" {
+		t.Fatalf("expected no Set-Cookie header but got %s", h)
+	}
+}
+
+func TestTemplMiddlewareTwice(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	h := s.TemplMiddleware(s.TemplMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if flashes := s.FlashesCtx(r.Context()); flashes["key"] != "value" {
+			t.Errorf("expected flash value but got %v", flashes["key"])
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})))
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.Flash(rr, req, "key", "value")
+	cookies := rr.Result().Cookies()
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d", http.StatusCreated, rr.Code)
+	}
+	if body := rr.Body.String(); body != "hello" {
+		t.Fatalf("expected body hello but got %q", body)
+	}
+
+	cookies = rr.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie but got %d", len(cookies))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[0])
+	if flashes := s.Flashes(httptest.NewRecorder(), req); len(flashes) != 0 {
+		t.Fatalf("expected flashes to be consumed but got %v", flashes)
+	}
+}
+
+type testCtxKey struct{}
+
+func TestSessionContextKey(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32), Options{ContextKey: testCtxKey{}})
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.Flash(rr, req, "key", "value")
+	cookies := rr.Result().Cookies()
+
+	h := s.TemplMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Move the session to a context that only has the custom key, as
+		// middleware that replaces the request's context would.
+		ctx := context.WithValue(context.Background(), testCtxKey{}, r.Context().Value(testCtxKey{}))
+		if flashes := s.FlashesCtx(ctx); flashes["key"] != "value" {
+			t.Errorf("expected flash value but got %v", flashes["key"])
+		}
+
+		s.Set(w, r.WithContext(ctx), "other", "value")
+		if v := s.Get(r, "other"); v != "value" {
+			t.Errorf("expected value set with the custom key but got %v", v)
+		}
+	}))
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+	h.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestTemplMiddlewareReadOnly(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.Set(rr, req, "key", "value")
+	cookies := rr.Result().Cookies()
+
+	h := s.TemplMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := s.Get(r, "key"); v != "value" {
+			t.Errorf("expected value but got %v", v)
+		}
+		s.FlashesCtx(r.Context())
+		w.Write([]byte("hello"))
+	}))
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+	h.ServeHTTP(rr, req)
+
+	if h := rr.Header().Get("Set-Cookie"); h != "" {
+		t.Fatalf("expected no Set-Cookie header but got %s", h)
+	}
+	if body := rr.Body.String(); body != "hello" {
+		t.Fatalf("expected body hello but got %q", body)
+	}
+}
+
+func TestTemplMiddlewareChanges(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.Set(rr, req, "unchanged", 1)
+	s.Set(rr, req, "modified", "before")
+	s.Set(rr, req, "removed", true)
+	cookies := rr.Result().Cookies()
+
+	h := s.TemplMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Set(w, r, "unchanged", 1)
+		s.Set(w, r, "modified", "after")
+		s.Set(w, r, "added", "value")
+		s.Delete(w, r, "removed")
+
+		added, modified, removed := s.ChangesCtx(r.Context())
+		if !reflect.DeepEqual(added, []string{"added"}) {
+			t.Errorf("expected added keys [added] but got %v", added)
+		}
+		if !reflect.DeepEqual(modified, []string{"modified"}) {
+			t.Errorf("expected modified keys [modified] but got %v", modified)
+		}
+		if !reflect.DeepEqual(removed, []string{"removed"}) {
+			t.Errorf("expected removed keys [removed] but got %v", removed)
+		}
+	}))
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Without a cookie, every key is added.
+	h = s.TemplMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Set(w, r, "key", "value")
+
+		added, modified, removed := s.ChangesCtx(r.Context())
+		if !reflect.DeepEqual(added, []string{"key"}) || modified != nil || removed != nil {
+			t.Errorf("expected only added keys but got %v, %v, %v", added, modified, removed)
+		}
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
 func TestTemplMiddlewareGlobal(t *testing.T) {
 	t.Parallel()
 
@@ -502,6 +3335,70 @@ func TestTemplMiddlewareGlobal(t *testing.T) {
 	}
 }
 
+func TestTemplMiddlewareSizeInfo(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+
+	var info SizeInfo
+	h := s.TemplMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Set(w, r, "blob", strings.Repeat("a", 1024))
+		info = s.SizeInfoCtx(r.Context())
+	}))
+
+	// Send a request with a small session cookie.
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	s.Set(rr, req, "key", "value")
+	before := rr.Result().Cookies()[0]
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(before)
+	h.ServeHTTP(rr, req)
+
+	cookies := rr.Result().Cookies()
+	after := cookies[len(cookies)-1]
+
+	if info.Before != len(before.Value) {
+		t.Fatalf("expected size before to be %d but got %d", len(before.Value), info.Before)
+	}
+	if info.After != len(after.Value) {
+		t.Fatalf("expected size after to be %d but got %d", len(after.Value), info.After)
+	}
+	if info.After <= info.Before+1024 {
+		t.Fatalf("expected session to grow by more than 1024 bytes but got %+v", info)
+	}
+}
+
+func TestSessionConcurrentRequests(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+
+	h := s.TemplMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Set(w, r, "key", s.Get(r, "key"))
+		s.Flash(w, r, "flash", "value")
+		w.Write([]byte("Hello, world!"))
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if rr.Result().Header.Get("Set-Cookie") == "" {
+				t.Error("expected Set-Cookie header but got empty string")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
 func BenchmarkTemplMiddleware(b *testing.B) {
 	s := New(GenerateRandomKey(32))
 
@@ -518,3 +3415,87 @@ func BenchmarkTemplMiddleware(b *testing.B) {
 		h.ServeHTTP(w, r)
 	}
 }
+
+func BenchmarkSessionGetNoCookie(b *testing.B) {
+	s := New(GenerateRandomKey(32))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s.Get(r, "key")
+	}
+}
+
+// benchmarkRequest returns a request with a session cookie holding a
+// representative amount of session data.
+func benchmarkRequest(b *testing.B, s *Session) *http.Request {
+	b.Helper()
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; i < 10; i++ {
+		s.Set(rr, req, fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+
+	cookies := rr.Result().Cookies()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[len(cookies)-1])
+	return req
+}
+
+func BenchmarkSessionGetRepeated(b *testing.B) {
+	s := New(GenerateRandomKey(32))
+	r := benchmarkRequest(b, s)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		// Read from a new request each time, with the cache installed by
+		// the Middleware, as a chain of middleware reading from it would.
+		req := r.WithContext(context.WithValue(r.Context(), cacheCtxKeyType{s: s}, &sessionCache{}))
+		for j := 0; j < 3; j++ {
+			s.Get(req, "key0")
+		}
+	}
+}
+
+func BenchmarkSessionVerify(b *testing.B) {
+	s := New(GenerateRandomKey(32))
+	r := benchmarkRequest(b, s)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s.Verify(r)
+	}
+}
+
+func BenchmarkSessionFromReq(b *testing.B) {
+	s := New(GenerateRandomKey(32))
+	r := benchmarkRequest(b, s)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		// Use a copy of the request each time, since the decoded session is
+		// attached to the request.
+		req := *r
+		s.fromReq(&req)
+	}
+}
+
+func BenchmarkSessionSet(b *testing.B) {
+	s := New(GenerateRandomKey(32))
+	r := benchmarkRequest(b, s)
+	w := &writeRecorder{header: make(http.Header)}
+
+	// Decode the session into the request's context up front, and set it
+	// using a copy of the request each time, so that only saving the
+	// session is measured.
+	s.Set(w, r, "key0", "value0")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := *r
+		s.Set(w, &req, "key0", "value0")
+		w.header.Del("Set-Cookie")
+	}
+}
@@ -0,0 +1,94 @@
+// Package sessionstest provides utilities for testing handlers that use
+// sessions.
+package sessionstest
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+
+	"github.com/bentranter/sessions"
+)
+
+// Server starts and returns a new TLS server that serves the given handler
+// wrapped in the session's TemplMiddleware. The caller should call Close when
+// finished, to shut it down.
+//
+// The server's Client has a cookie jar, so session cookies set by one
+// request are sent with every subsequent request made using the client. A
+// TLS server is used since session cookies are always set with the Secure
+// attribute, and would not otherwise be sent by the client.
+func Server(s *sessions.Session, h http.Handler) *httptest.Server {
+	srv := httptest.NewTLSServer(s.TemplMiddleware(h))
+
+	// The only error returned by cookiejar.New is from the public suffix
+	// list, which is unset.
+	jar, _ := cookiejar.New(nil)
+	srv.Client().Jar = jar
+	return srv
+}
+
+// A CookieRecorder is an httptest.ResponseRecorder that also records the
+// cookies set on the response, which allows tests to check the session
+// cookies set by a handler without parsing the Set-Cookie header.
+type CookieRecorder struct {
+	*httptest.ResponseRecorder
+
+	cookies []*http.Cookie
+	wrote   bool
+}
+
+// NewCookieRecorder returns an initialized CookieRecorder.
+func NewCookieRecorder() *CookieRecorder {
+	return &CookieRecorder{ResponseRecorder: httptest.NewRecorder()}
+}
+
+// Cookies returns the cookies set on the response, in the order that they
+// were set. Once the response has been written, cookies set afterwards are
+// not included, since they would not be sent to the client.
+func (cr *CookieRecorder) Cookies() []*http.Cookie {
+	if cr.wrote {
+		return cr.cookies
+	}
+	return readCookies(cr.Header())
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (cr *CookieRecorder) WriteHeader(code int) {
+	cr.snapshot()
+	cr.ResponseRecorder.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter.
+func (cr *CookieRecorder) Write(b []byte) (int, error) {
+	cr.snapshot()
+	return cr.ResponseRecorder.Write(b)
+}
+
+// WriteString implements io.StringWriter.
+func (cr *CookieRecorder) WriteString(str string) (int, error) {
+	cr.snapshot()
+	return cr.ResponseRecorder.WriteString(str)
+}
+
+// Flush implements http.Flusher.
+func (cr *CookieRecorder) Flush() {
+	cr.snapshot()
+	cr.ResponseRecorder.Flush()
+}
+
+// snapshot records the cookies set on the response when it is first
+// written.
+func (cr *CookieRecorder) snapshot() {
+	if cr.wrote {
+		return
+	}
+	cr.wrote = true
+	cr.cookies = readCookies(cr.Header())
+}
+
+// readCookies parses the cookies from the Set-Cookie headers of the given
+// header.
+func readCookies(h http.Header) []*http.Cookie {
+	return (&http.Response{Header: h}).Cookies()
+}
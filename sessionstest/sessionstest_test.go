@@ -0,0 +1,80 @@
+package sessionstest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bentranter/sessions"
+)
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+
+	s := sessions.New(sessions.GenerateRandomKey(32))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/set", func(w http.ResponseWriter, r *http.Request) {
+		s.Set(w, r, "name", "Ben")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) {
+		name, _ := s.Get(r, "name").(string)
+		w.Write([]byte(name))
+	})
+
+	srv := Server(s, mux)
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "/set")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	resp, err = srv.Client().Get(srv.URL + "/get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "Ben" {
+		t.Fatalf("expected Ben but got %s", body)
+	}
+}
+
+func TestCookieRecorder(t *testing.T) {
+	t.Parallel()
+
+	s := sessions.New(sessions.GenerateRandomKey(32))
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Set(w, r, "name", "Ben")
+		w.WriteHeader(http.StatusNoContent)
+
+		// Cookies set after the response is written aren't sent.
+		http.SetCookie(w, &http.Cookie{Name: "late", Value: "value"})
+	})
+
+	rec := NewCookieRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	cookies := rec.Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie but got %d", len(cookies))
+	}
+	if cookies[0].Name != "_session" {
+		t.Fatalf("expected cookie named _session but got %s", cookies[0].Name)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[0])
+	if name := s.Get(req, "name"); name != "Ben" {
+		t.Fatalf("expected Ben but got %v", name)
+	}
+}
@@ -0,0 +1,110 @@
+package sessions
+
+import (
+	"math"
+	"net/http"
+)
+
+// GetInt returns the session value for the given key as an int, and whether
+// or not the value is present and is an integer.
+//
+// Numbers don't always decode with the type they were set with, for
+// example, an int may be decoded as a uint64 or a float64 depending on how
+// the session is encoded, so GetInt accepts any integer or integral floating
+// point value that fits in an int.
+func (s *Session) GetInt(r *http.Request, key string) (int, bool) {
+	switch n := s.Get(r, key).(type) {
+	case int:
+		return n, true
+	case int8:
+		return int(n), true
+	case int16:
+		return int(n), true
+	case int32:
+		return int(n), true
+	case int64:
+		if n < math.MinInt || n > math.MaxInt {
+			return 0, false
+		}
+		return int(n), true
+	case uint:
+		if n > math.MaxInt {
+			return 0, false
+		}
+		return int(n), true
+	case uint8:
+		return int(n), true
+	case uint16:
+		return int(n), true
+	case uint32:
+		if uint64(n) > math.MaxInt {
+			return 0, false
+		}
+		return int(n), true
+	case uint64:
+		if n > math.MaxInt {
+			return 0, false
+		}
+		return int(n), true
+	case float32:
+		return floatToInt(float64(n))
+	case float64:
+		return floatToInt(n)
+	}
+	return 0, false
+}
+
+// floatToInt converts f to an int if it's an integer that fits in an int.
+func floatToInt(f float64) (int, bool) {
+	if f != math.Trunc(f) || f < math.MinInt || f >= math.MaxInt {
+		return 0, false
+	}
+	return int(f), true
+}
+
+// GetFloat64 returns the session value for the given key as a float64, and
+// whether or not the value is present and is a number. Like GetInt, it
+// accepts a number of any type.
+func (s *Session) GetFloat64(r *http.Request, key string) (float64, bool) {
+	switch n := s.Get(r, key).(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// GetString returns the session value for the given key as a string, and
+// whether or not the value is present and is a string.
+func (s *Session) GetString(r *http.Request, key string) (string, bool) {
+	v, ok := s.Get(r, key).(string)
+	return v, ok
+}
+
+// GetBool returns the session value for the given key as a bool, and whether
+// or not the value is present and is a bool.
+func (s *Session) GetBool(r *http.Request, key string) (bool, bool) {
+	v, ok := s.Get(r, key).(bool)
+	return v, ok
+}
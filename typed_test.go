@@ -0,0 +1,107 @@
+package sessions
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSessionGetInt(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+
+	// Decode a JSON encoded number the same way a JSON codec would.
+	var jsonValue interface{}
+	if err := json.Unmarshal([]byte("5"), &jsonValue); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		value interface{}
+	}{
+		{name: "int", value: 5},
+		{name: "int64", value: int64(5)},
+		{name: "uint64", value: uint64(5)},
+		{name: "float64 from JSON", value: jsonValue},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			s.Set(rr, req, "n", c.value)
+
+			if n, ok := s.GetInt(req, "n"); !ok || n != 5 {
+				t.Fatalf("expected 5 but got %d, %t", n, ok)
+			}
+
+			// Confirm the value is the same once decoded from the cookie.
+			cookies := rr.Result().Cookies()
+			req = httptest.NewRequest(http.MethodGet, "/", nil)
+			req.AddCookie(cookies[len(cookies)-1])
+
+			if n, ok := s.GetInt(req, "n"); !ok || n != 5 {
+				t.Fatalf("expected 5 from cookie but got %d, %t", n, ok)
+			}
+		})
+	}
+
+	t.Run("non-integers are rejected", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		s.Set(rr, req, "float", 5.5)
+		s.Set(rr, req, "string", "5")
+
+		if n, ok := s.GetInt(req, "float"); ok {
+			t.Fatalf("expected 5.5 to be rejected but got %d", n)
+		}
+		if n, ok := s.GetInt(req, "string"); ok {
+			t.Fatalf("expected string to be rejected but got %d", n)
+		}
+		if n, ok := s.GetInt(req, "missing"); ok {
+			t.Fatalf("expected missing key to be rejected but got %d", n)
+		}
+	})
+}
+
+func TestSessionGetFloat64(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Set(rr, req, "int", 5)
+	s.Set(rr, req, "float", 5.5)
+
+	if f, ok := s.GetFloat64(req, "int"); !ok || f != 5 {
+		t.Fatalf("expected 5 but got %f, %t", f, ok)
+	}
+	if f, ok := s.GetFloat64(req, "float"); !ok || f != 5.5 {
+		t.Fatalf("expected 5.5 but got %f, %t", f, ok)
+	}
+}
+
+func TestSessionGetStringBool(t *testing.T) {
+	t.Parallel()
+
+	s := New(GenerateRandomKey(32))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	s.Set(rr, req, "name", "Ben")
+	s.Set(rr, req, "admin", true)
+
+	if v, ok := s.GetString(req, "name"); !ok || v != "Ben" {
+		t.Fatalf("expected Ben but got %s, %t", v, ok)
+	}
+	if v, ok := s.GetString(req, "admin"); ok {
+		t.Fatalf("expected bool to be rejected but got %s", v)
+	}
+	if v, ok := s.GetBool(req, "admin"); !ok || !v {
+		t.Fatalf("expected true but got %t, %t", v, ok)
+	}
+}